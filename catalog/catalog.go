@@ -0,0 +1,157 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package catalog renders the texts sent by the bot from per-locale
+// text/template files.  Each locale is a file <locale>.tmpl defining one named
+// template per text.  Defaults are embedded in the binary; files in the
+// configured directory add locales or override individual texts.
+
+package catalog
+
+import (
+	"bytes"
+	"embed"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Extension of locale files
+const extension = ".tmpl"
+
+// DefaultLocale is used for users without a language preference & for texts
+// missing from their locale
+const DefaultLocale = "en"
+
+//go:embed locales/*.tmpl
+var defaults embed.FS
+
+// Data holds the values a text is rendered with
+type Data map[string]interface{}
+
+// Catalog holds the templates of every locale
+type Catalog struct {
+	locales map[string]*template.Template
+}
+
+// New loads the embedded locales, then the locale files in dir if it is set
+func New(dir string) (*Catalog, error) {
+	c := &Catalog{locales: map[string]*template.Template{}}
+
+	files, err := fs.Glob(defaults, "locales/*"+extension)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := defaults.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		err = c.parse(file, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dir != "" {
+		files, err = filepath.Glob(filepath.Join(dir, "*"+extension))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to list locale files in %s", dir)
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "Failed to read locale file %s", file)
+			}
+			err = c.parse(file, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// Default returns the catalog of embedded locales
+func Default() *Catalog {
+	c, err := New("")
+	if err != nil {
+		jww.FATAL.Panicf("Failed to load embedded locales: %+v", err)
+	}
+	return c
+}
+
+// Has returns whether the locale is in the catalog
+func (c *Catalog) Has(locale string) bool {
+	_, ok := c.locales[strings.ToLower(locale)]
+	return ok
+}
+
+// Locales returns the names of every locale in the catalog
+func (c *Catalog) Locales() []string {
+	var locales []string
+	for locale := range c.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Render returns the named text in the locale, falling back to the default
+// locale if the locale or text is missing or fails to render
+func (c *Catalog) Render(locale, name string, data Data) string {
+	locale = strings.ToLower(locale)
+	if locale != DefaultLocale {
+		if text, err := c.render(locale, name, data); err == nil {
+			return text
+		} else if c.Has(locale) {
+			jww.WARN.Printf("Failed to render %s in %s: %+v", name, locale, err)
+		}
+	}
+
+	text, err := c.render(DefaultLocale, name, data)
+	if err != nil {
+		jww.ERROR.Printf("Failed to render %s: %+v", name, err)
+	}
+	return text
+}
+
+// render executes the named template of the locale
+func (c *Catalog) render(locale, name string, data Data) (string, error) {
+	t, ok := c.locales[locale]
+	if !ok {
+		return "", errors.Errorf("no locale %s", locale)
+	}
+	t = t.Lookup(name)
+	if t == nil {
+		return "", errors.Errorf("no text %s in locale %s", name, locale)
+	}
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+// parse adds the templates in the file to its locale, replacing any of the
+// same name
+func (c *Catalog) parse(file string, data []byte) error {
+	locale := strings.ToLower(strings.TrimSuffix(filepath.Base(file), extension))
+	t, ok := c.locales[locale]
+	if !ok {
+		t = template.New(locale).Option("missingkey=zero")
+	}
+	t, err := t.Parse(string(data))
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to parse locale file %s", file)
+	}
+	c.locales[locale] = t
+	return nil
+}
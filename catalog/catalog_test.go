@@ -0,0 +1,70 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package catalog
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeLocales writes each locale file to a new directory, returning it
+func writeLocales(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %+v", name, err)
+		}
+	}
+	return dir
+}
+
+// Tests that locale files override single texts of the embedded locales &
+// add locales, & that missing locales & texts fall back to the default
+func TestCatalog_Render(t *testing.T) {
+	dir := writeLocales(t, map[string]string{
+		"en.tmpl": `{{define "status.none"}}Not registered{{end}}`,
+		"DE.tmpl": `{{define "usage"}}Verwendung: {{.Signature}}{{end}}`,
+	})
+	c, err := New(dir)
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %+v", err)
+	}
+	defaults := Default()
+
+	if !c.Has("de") || !c.Has("EN") || c.Has("fr") {
+		t.Errorf("Unexpected locales %v", c.Locales())
+	}
+	tests := []struct {
+		locale, name, expected string
+	}{
+		{"en", "status.none", "Not registered"},
+		{"de", "status.none", "Not registered"},
+		{"en", "usage", defaults.Render("en", "usage", Data{"Signature": "lang"})},
+		{"DE", "usage", "Verwendung: lang"},
+		{"fr", "usage", defaults.Render("en", "usage", Data{"Signature": "lang"})},
+		{"de", "help.missing", ""},
+	}
+	for _, test := range tests {
+		text := c.Render(test.locale, test.name, Data{"Signature": "lang"})
+		if text != test.expected {
+			t.Errorf("Render(%s, %s) returned %q, expected %q",
+				test.locale, test.name, text, test.expected)
+		}
+	}
+}
+
+// Tests that invalid locale files are refused
+func TestNew_Invalid(t *testing.T) {
+	dir := writeLocales(t, map[string]string{"en.tmpl": `{{define "usage"}}{{.Signature}`})
+	if _, err := New(dir); err == nil {
+		t.Error("Expected an error loading an invalid locale file")
+	}
+}
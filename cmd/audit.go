@@ -0,0 +1,40 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+var auditLimit int
+
+// auditCmd prints the most recent commands run by admins over cMix
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "List the most recent admin commands sent to the bot, newest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		actions, err := initStorage(true).GetAdminActions(auditLimit)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get admin actions: %+v", err)
+		}
+		for _, a := range actions {
+			fmt.Printf("%s\t%s\t%s\t%s\n", a.CreatedAt.Format(time.RFC3339),
+				a.AdminID, a.Command, a.Response)
+		}
+	},
+}
+
+func init() {
+	auditCmd.Flags().IntVarP(&auditLimit, "limit", "n", 50,
+		"Maximum number of actions to list.")
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,113 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// blocklistCmd groups the commands for managing the user & code blocklists
+var blocklistCmd = &cobra.Command{
+	Use:   "blocklist",
+	Short: "Manage blocked users and codes",
+}
+
+// blockUserCmd adds a user to the blocklist
+var blockUserCmd = &cobra.Command{
+	Use:   "add-user <userID>",
+	Short: "Block a user from registering or contacting the bot",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).BlockUser(args[0], reason)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to block user %s: %+v", args[0], err)
+		}
+		fmt.Printf("Blocked user %s\n", args[0])
+	},
+}
+
+// unblockUserCmd removes a user from the blocklist
+var unblockUserCmd = &cobra.Command{
+	Use:   "remove-user <userID>",
+	Short: "Remove a user from the blocklist",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).UnblockUser(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to unblock user %s: %+v", args[0], err)
+		}
+		fmt.Printf("Unblocked user %s\n", args[0])
+	},
+}
+
+// blockCodeCmd adds a code to the blocklist
+var blockCodeCmd = &cobra.Command{
+	Use:   "add-code <code>",
+	Short: "Block a code from being used to register",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).BlockCode(args[0], reason)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to block code %s: %+v", args[0], err)
+		}
+		fmt.Printf("Blocked code %s\n", args[0])
+	},
+}
+
+// unblockCodeCmd removes a code from the blocklist
+var unblockCodeCmd = &cobra.Command{
+	Use:   "remove-code <code>",
+	Short: "Remove a code from the blocklist",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).UnblockCode(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to unblock code %s: %+v", args[0], err)
+		}
+		fmt.Printf("Unblocked code %s\n", args[0])
+	},
+}
+
+// listBlockedCmd prints the blocked users & codes
+var listBlockedCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List blocked users and codes",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := initStorage(true)
+		users, err := s.GetBlockedUsers()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get blocked users: %+v", err)
+		}
+		for _, b := range users {
+			fmt.Printf("user\t%s\t%s\t%s\n", b.ID, b.CreatedAt.Format(time.RFC3339), b.Reason)
+		}
+
+		codes, err := s.GetBlockedCodes()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get blocked codes: %+v", err)
+		}
+		for _, b := range codes {
+			fmt.Printf("code\t%s\t%s\t%s\n", b.Code, b.CreatedAt.Format(time.RFC3339), b.Reason)
+		}
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{blockUserCmd, blockCodeCmd} {
+		c.Flags().StringVarP(&reason, "reason", "r", "",
+			"Reason recorded with the block.")
+	}
+
+	blocklistCmd.AddCommand(blockUserCmd, unblockUserCmd, blockCodeCmd,
+		unblockCodeCmd, listBlockedCmd)
+	rootCmd.AddCommand(blocklistCmd)
+}
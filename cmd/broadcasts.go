@@ -0,0 +1,115 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var segmentStatus string
+
+// broadcastCmd groups the commands for managing broadcasts
+var broadcastCmd = &cobra.Command{
+	Use:   "broadcast",
+	Short: "Manage announcements broadcast to registered users",
+}
+
+// sendBroadcastCmd starts a broadcast, which the running bot delivers
+var sendBroadcastCmd = &cobra.Command{
+	Use:   "send <text>",
+	Short: "Broadcast a message to all registered users, or a segment of them",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := initStorage(true).CreateBroadcast(strings.Join(args, " "), storage.Segment{
+			Campaign: campaign,
+			Status:   segmentStatus,
+		})
+		if err != nil {
+			jww.FATAL.Panicf("Failed to create broadcast: %+v", err)
+		}
+		fmt.Printf("Created broadcast %d to %d users\n", b.ID, b.Recipients)
+	},
+}
+
+// listBroadcastsCmd prints the progress of every broadcast
+var listBroadcastsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List broadcasts and their delivery progress",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := initStorage(true)
+		broadcasts, err := s.GetBroadcasts()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get broadcasts: %+v", err)
+		}
+		for _, b := range broadcasts {
+			counts, err := s.CountDeliveries(b.ID)
+			if err != nil {
+				jww.FATAL.Panicf("Failed to count deliveries of broadcast %d: %+v", b.ID, err)
+			}
+			fmt.Printf("%d\t%s\t%s\t%d queued, %d sent, %d failed, %d skipped\t%s\n",
+				b.ID, b.CreatedAt.Format(time.RFC3339), b.State, counts[storage.MessageQueued],
+				counts[storage.MessageSent], counts[storage.MessageFailed],
+				counts[storage.MessageSkipped], b.Text)
+		}
+	},
+}
+
+// cancelBroadcastCmd stops delivering a broadcast
+var cancelBroadcastCmd = &cobra.Command{
+	Use:   "cancel <id>",
+	Short: "Stop delivering a broadcast",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).CancelBroadcast(parseBroadcastID(args[0]))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to cancel broadcast %s: %+v", args[0], err)
+		}
+		fmt.Printf("Cancelled broadcast %s\n", args[0])
+	},
+}
+
+// resumeBroadcastCmd continues delivering a cancelled broadcast
+var resumeBroadcastCmd = &cobra.Command{
+	Use:   "resume <id>",
+	Short: "Continue delivering a cancelled broadcast to the remaining users",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).ResumeBroadcast(parseBroadcastID(args[0]))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to resume broadcast %s: %+v", args[0], err)
+		}
+		fmt.Printf("Resumed broadcast %s\n", args[0])
+	},
+}
+
+// parseBroadcastID parses a broadcast ID given on the command line
+func parseBroadcastID(raw string) uint64 {
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		jww.FATAL.Panicf("Invalid broadcast ID %s: %+v", raw, err)
+	}
+	return id
+}
+
+func init() {
+	sendBroadcastCmd.Flags().StringVar(&campaign, "campaign", "",
+		"Only send to users registered with a code in this campaign.")
+	sendBroadcastCmd.Flags().StringVar(&segmentStatus, "status", "",
+		"Only send to users whose registration has this status.")
+
+	broadcastCmd.AddCommand(sendBroadcastCmd, listBroadcastsCmd, cancelBroadcastCmd,
+		resumeBroadcastCmd)
+	rootCmd.AddCommand(broadcastCmd)
+}
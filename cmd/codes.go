@@ -0,0 +1,96 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// codesCmd groups the commands for managing referral codes
+var codesCmd = &cobra.Command{
+	Use:   "codes",
+	Short: "Manage referral codes",
+}
+
+var ownerID, payoutAddress, campaign string
+var tags []string
+
+// createCodeCmd adds a new referral code
+var createCodeCmd = &cobra.Command{
+	Use:   "create <code>",
+	Short: "Create a referral code, optionally owned by a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).CreateCode(args[0], campaign, ownerID, payoutAddress, tags)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to create code %s: %+v", args[0], err)
+		}
+		fmt.Printf("Created code %s\n", args[0])
+	},
+}
+
+// setOwnerCmd sets the owner & payout address of a code
+var setOwnerCmd = &cobra.Command{
+	Use:   "set-owner <code>",
+	Short: "Set the user which owns a code and the address its rewards are paid to",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).SetCodeOwner(args[0], ownerID, payoutAddress)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to set owner of code %s: %+v", args[0], err)
+		}
+		fmt.Printf("Set owner of code %s\n", args[0])
+	},
+}
+
+// holdCmd holds registrations using a code for review
+var holdCmd = &cobra.Command{
+	Use:   "hold <code>",
+	Short: "Hold all further registrations using a code for review",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).HoldCode(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to hold code %s: %+v", args[0], err)
+		}
+		fmt.Printf("Holding registrations using code %s for review\n", args[0])
+	},
+}
+
+// releaseCmd lifts the review hold on a code
+var releaseCmd = &cobra.Command{
+	Use:   "release <code>",
+	Short: "Stop holding registrations using a code for review",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).ReleaseCode(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to release code %s: %+v", args[0], err)
+		}
+		fmt.Printf("Released code %s\n", args[0])
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{createCodeCmd, setOwnerCmd} {
+		c.Flags().StringVarP(&ownerID, "owner", "o", "",
+			"Base64 encoded ID of the user which owns the code.")
+		c.Flags().StringVarP(&payoutAddress, "payout", "p", "",
+			"Address the code's rewards are paid out to.")
+	}
+
+	createCodeCmd.Flags().StringVar(&campaign, "campaign", "",
+		"Campaign the code belongs to.")
+	createCodeCmd.Flags().StringSliceVar(&tags, "tags", nil,
+		"Comma separated labels matched by the reward rules.")
+
+	codesCmd.AddCommand(createCodeCmd, setOwnerCmd, holdCmd, releaseCmd)
+	rootCmd.AddCommand(codesCmd)
+}
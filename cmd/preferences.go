@@ -0,0 +1,69 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+var notificationSetting, language string
+
+// preferencesCmd groups the commands for managing users' message preferences
+var preferencesCmd = &cobra.Command{
+	Use:   "preferences",
+	Short: "Manage users' preferences for messages sent by the bot",
+}
+
+// showPreferencesCmd prints a user's preferences
+var showPreferencesCmd = &cobra.Command{
+	Use:   "show <userID>",
+	Short: "Show a user's message preferences",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := initStorage(true).GetPreferences(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get preferences of %s: %+v", args[0], err)
+		}
+		fmt.Printf("notifications\t%s\nlanguage\t%s\n", p.Notifications, p.Language)
+	},
+}
+
+// setPreferencesCmd changes a user's preferences
+var setPreferencesCmd = &cobra.Command{
+	Use:   "set <userID>",
+	Short: "Change a user's message preferences",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s := initStorage(true)
+		if cmd.Flags().Changed("notifications") {
+			err := s.SetNotifications(args[0], notificationSetting)
+			if err != nil {
+				jww.FATAL.Panicf("Failed to set notifications of %s: %+v", args[0], err)
+			}
+		}
+		if cmd.Flags().Changed("language") {
+			err := s.SetLanguage(args[0], language)
+			if err != nil {
+				jww.FATAL.Panicf("Failed to set language of %s: %+v", args[0], err)
+			}
+		}
+		fmt.Printf("Updated preferences of %s\n", args[0])
+	},
+}
+
+func init() {
+	setPreferencesCmd.Flags().StringVar(&notificationSetting, "notifications", "",
+		"Messages the user is sent other than replies: all, digest or none.")
+	setPreferencesCmd.Flags().StringVar(&language, "language", "",
+		"Language of the bot's messages, or empty for the default.")
+
+	preferencesCmd.AddCommand(showPreferencesCmd, setPreferencesCmd)
+	rootCmd.AddCommand(preferencesCmd)
+}
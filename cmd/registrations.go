@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+var (
+	reason      string
+	reviewLimit int
+	notify      bool
+)
+
+// registrationsCmd groups the commands for managing registrations
+var registrationsCmd = &cobra.Command{
+	Use:   "registrations",
+	Short: "Manage registrations made with the incentives bot",
+}
+
+// reviewCmd lists the registrations awaiting review
+var reviewCmd = &cobra.Command{
+	Use:   "review",
+	Short: "List registrations held for review, oldest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := initStorage(true)
+		users, err := s.GetReviewQueue(reviewLimit)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get review queue: %+v", err)
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\t%s\n", u.ID, u.Code, u.CreatedAt.Format(time.RFC3339))
+		}
+	},
+}
+
+// approveCmd approves a pending registration
+var approveCmd = &cobra.Command{
+	Use:   "approve <userID>",
+	Short: "Approve a registration held for review, crediting its code",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).ApproveRegistration(args[0], reason)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to approve registration %s: %+v", args[0], err)
+		}
+		fmt.Printf("Approved registration %s\n", args[0])
+	},
+}
+
+// rejectCmd rejects a pending registration
+var rejectCmd = &cobra.Command{
+	Use:   "reject <userID>",
+	Short: "Reject a registration held for review",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).RejectRegistration(args[0], reason)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to reject registration %s: %+v", args[0], err)
+		}
+		fmt.Printf("Rejected registration %s\n", args[0])
+	},
+}
+
+// payCmd marks an approved registration as paid
+var payCmd = &cobra.Command{
+	Use:   "pay <userID>",
+	Short: "Record that the rewards for an approved registration were paid",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).MarkPaid(args[0], reason)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to mark registration %s paid: %+v", args[0], err)
+		}
+		fmt.Printf("Marked registration %s paid\n", args[0])
+	},
+}
+
+// reverseCmd reverses an approved or paid registration
+var reverseCmd = &cobra.Command{
+	Use:   "reverse <userID>",
+	Short: "Reverse a registration, debiting the rewards credited for it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initStorage(true).ReverseRegistration(args[0], reason, notify)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to reverse registration %s: %+v", args[0], err)
+		}
+		fmt.Printf("Reversed registration %s\n", args[0])
+	},
+}
+
+// historyCmd prints the state changes & ledger entries of a registration
+var historyCmd = &cobra.Command{
+	Use:   "history <userID>",
+	Short: "Show the state changes and ledger entries of a registration",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s := initStorage(true)
+		changes, err := s.GetStatusChanges(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get state changes of %s: %+v", args[0], err)
+		}
+		for _, c := range changes {
+			fmt.Printf("%s\t%s -> %s\t%s\n", c.CreatedAt.Format(time.RFC3339),
+				c.OldStatus, c.NewStatus, c.Reason)
+		}
+
+		entries, err := s.GetLedgerEntries(args[0])
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get ledger entries of %s: %+v", args[0], err)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s\t%s\t%+d\t%s\ttier %d\n", e.CreatedAt.Format(time.RFC3339),
+				e.Code, e.Amount, e.Kind, e.Tier)
+		}
+	},
+}
+
+func init() {
+	reviewCmd.Flags().IntVarP(&reviewLimit, "limit", "n", 50,
+		"Maximum number of registrations to list.")
+	for _, c := range []*cobra.Command{approveCmd, rejectCmd, payCmd, reverseCmd} {
+		c.Flags().StringVarP(&reason, "reason", "r", "",
+			"Reason recorded with the state change.")
+	}
+	rejectCmd.MarkFlagRequired("reason")
+	reverseCmd.MarkFlagRequired("reason")
+	reverseCmd.Flags().BoolVar(&notify, "notify", false,
+		"Send the user a message with the reason for the reversal.")
+
+	registrationsCmd.AddCommand(reviewCmd, approveCmd, rejectCmd, payCmd,
+		reverseCmd, historyCmd)
+	rootCmd.AddCommand(registrationsCmd)
+}
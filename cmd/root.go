@@ -9,9 +9,12 @@ package cmd
 
 import (
 	"fmt"
+	"git.xx.network/elixxir/incentives-bot/catalog"
 	"git.xx.network/elixxir/incentives-bot/incentives"
+	"git.xx.network/elixxir/incentives-bot/rules"
 	"git.xx.network/elixxir/incentives-bot/storage"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/skip2/go-qrcode"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
@@ -39,50 +42,21 @@ var rootCmd = &cobra.Command{
 	Short: "",
 	Long:  "",
 	Args:  cobra.NoArgs,
-	Run: func(cmd *cobra.Command, args []string) {
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		// Initialize config & logging
 		initConfig()
 		initLog()
-
-		// Get database parameters
-		rawAddr := viper.GetString("dbAddress")
-		var addr, port string
-		var err error
-		if rawAddr != "" {
-			addr, port, err = net.SplitHostPort(rawAddr)
-			if err != nil {
-				jww.FATAL.Panicf("Unable to get database port from %s: %+v", rawAddr, err)
-			}
-		}
-
-		udRawAddr := viper.GetString("udbDbAddress")
-		var udAddr, udPort string
-		if rawAddr != "" {
-			addr, port, err = net.SplitHostPort(udRawAddr)
-			if err != nil {
-				jww.FATAL.Panicf("Unable to get database port from %s: %+v", rawAddr, err)
-			}
-		}
-
-		sp := storage.Params{
-			Username: viper.GetString("dbUsername"),
-			Password: viper.GetString("dbPassword"),
-			DBName:   viper.GetString("dbName"),
-			Address:  addr,
-			Port:     port,
-		}
-		udbParams := storage.Params{
-			Username: viper.GetString("UdDbUsername"),
-			Password: viper.GetString("UdDbPassword"),
-			DBName:   viper.GetString("UdDbName"),
-			Address:  udAddr,
-			Port:     udPort,
-		}
-
+	},
+	Run: func(cmd *cobra.Command, args []string) {
 		// Initialize storage object
-		s, err := storage.NewStorage(sp, udbParams)
+		s := initStorage(false)
+
+		// Count the phone numbers of registrations made before they were tracked
+		filled, err := s.BackfillPhoneHashes()
 		if err != nil {
-			jww.FATAL.Panicf("Failed to initialize storage interface: %+v", err)
+			jww.ERROR.Printf("Failed to backfill phone hashes after %d registrations: %+v", filled, err)
+		} else if filled > 0 {
+			jww.INFO.Printf("Backfilled phone hashes of %d registrations", filled)
 		}
 
 		// Get session parameters
@@ -166,49 +140,79 @@ var rootCmd = &cobra.Command{
 
 		// Create & register callback to confirm any authenticated channel requests
 		rcb := func(requestor contact.Contact) {
-			rid, err := cl.ConfirmAuthenticatedChannel(requestor)
-			if err != nil {
-				jww.ERROR.Printf("Failed to confirm authenticated channel to %+v: %+v", requestor, err)
-			}
-			jww.DEBUG.Printf("Authenticated channel to %+v created over round %d", requestor, rid)
-
-			time.Sleep(100 * time.Millisecond)
-
-			intro := "Thank you for using the xx network incentives bot!  Please send me your code."
-			payload := &incentives.CMIXText{
-				Version: 0,
-				Text:    intro,
-			}
-			marshalled, err := proto.Marshal(payload)
-			if err != nil {
-				jww.ERROR.Printf("Failed to marshal payload: %+v", err)
+			// Leave requests from blocked users, or which cannot be checked
+			// against the blocklist, unconfirmed
+			if blocked, err := s.IsUserBlocked(requestor.ID); err != nil {
+				jww.ERROR.Printf("Ignoring authenticated channel request from %s: %+v", requestor.ID, err)
 				return
-			}
-
-			contact, err := cl.GetAuthenticatedChannelRequest(requestor.ID)
-			if err != nil {
-				jww.ERROR.Printf("Could not get authenticated channel request info: %+v", err)
+			} else if blocked {
+				jww.INFO.Printf("Ignoring authenticated channel request from blocked user %s", requestor.ID)
 				return
 			}
 
-			// Create response message
-			resp := message.Send{
-				Recipient:   contact.ID,
-				Payload:     marshalled,
-				MessageType: message.XxMessage,
+			rid, err := cl.ConfirmAuthenticatedChannel(requestor)
+			if err != nil {
+				jww.ERROR.Printf("Failed to confirm authenticated channel to %+v: %+v", requestor, err)
 			}
+			jww.DEBUG.Printf("Authenticated channel to %+v created over round %d", requestor, rid)
 
-			rids, mid, t, err := cl.SendE2E(resp, params.GetDefaultE2E())
+			// Send the welcome, then any tips unless the user opts out first
+			w := s.Welcome(requestor.ID.String())
+			time.Sleep(w.Delay)
+			err = sendWelcome(cl, requestor, w.Text)
 			if err != nil {
-				jww.ERROR.Printf("Failed to send message: %+v", err)
+				jww.ERROR.Printf("Failed to send welcome to %+v: %+v", requestor, err)
 				return
 			}
-			jww.INFO.Printf("Sent intro [%+v] to %+v on rounds %+v [%+v]", mid, requestor, rids, t)
+			go func() {
+				for _, tip := range w.Tips {
+					time.Sleep(w.TipDelay)
+					if s.OptedOut(requestor.ID.String()) {
+						return
+					}
+					err := sendWelcome(cl, requestor, tip)
+					if err != nil {
+						jww.ERROR.Printf("Failed to send tip to %+v: %+v", requestor, err)
+						return
+					}
+				}
+			}()
 		}
 		cl.GetAuthRegistrar().AddGeneralRequestCallback(rcb)
 
 		// Create coupons impl & register listener on zero user for text messages
-		impl := incentives.New(s, cl)
+		ip := incentives.Params{
+			RateLimit: incentives.RateLimitParams{
+				UserCapacity:   viper.GetInt("rateLimitUserCapacity"),
+				UserPeriod:     viper.GetDuration("rateLimitUserPeriod"),
+				GlobalCapacity: viper.GetInt("rateLimitGlobalCapacity"),
+				GlobalPeriod:   viper.GetDuration("rateLimitGlobalPeriod"),
+			},
+			Admins:             getAdmins(),
+			AlertWebhook:       viper.GetString("alertWebhook"),
+			SendInterval:       viper.GetDuration("sendInterval"),
+			DigestInterval:     viper.GetDuration("digestInterval"),
+			BroadcastBatchSize: viper.GetInt("broadcastBatchSize"),
+			BroadcastInterval:  viper.GetDuration("broadcastInterval"),
+			ConversationTTL:    viper.GetDuration("conversationTTL"),
+			ConfirmCodes:       viper.GetBool("confirmCodes"),
+		}
+		if ip.SendInterval == 0 {
+			ip.SendInterval = 5 * time.Second
+		}
+		if ip.DigestInterval == 0 {
+			ip.DigestInterval = time.Hour
+		}
+		if ip.BroadcastBatchSize == 0 {
+			ip.BroadcastBatchSize = 10
+		}
+		if ip.BroadcastInterval == 0 {
+			ip.BroadcastInterval = 10 * time.Second
+		}
+		if ip.ConversationTTL == 0 {
+			ip.ConversationTTL = 10 * time.Minute
+		}
+		impl := incentives.New(s, cl, ip)
 		cl.GetSwitchboard().RegisterListener(&id.ZeroUser, message.XxMessage, impl)
 
 		// Start network follower
@@ -217,11 +221,153 @@ var rootCmd = &cobra.Command{
 			jww.FATAL.Panicf("Failed to start network follower: %+v", err)
 		}
 
+		// Start delivering queued alerts & notifications
+		impl.Start()
+
+		// Reload the reward rules when the file changes
+		rulesReloadInterval := viper.GetDuration("rulesReloadInterval")
+		if rulesReloadInterval == 0 {
+			rulesReloadInterval = 30 * time.Second
+		}
+		go s.WatchRules(rulesReloadInterval, make(chan struct{}))
+
 		// Wait 5ever
 		select {}
 	},
 }
 
+// sendWelcome sends a message from the welcome flow to a user whose
+// authenticated channel was just confirmed
+func sendWelcome(cl *api.Client, requestor contact.Contact, text string) error {
+	payload := &incentives.CMIXText{
+		Version: 0,
+		Text:    text,
+	}
+	marshalled, err := proto.Marshal(payload)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to marshal payload")
+	}
+
+	contact, err := cl.GetAuthenticatedChannelRequest(requestor.ID)
+	if err != nil {
+		return errors.WithMessage(err, "Could not get authenticated channel request info")
+	}
+
+	// Create response message
+	resp := message.Send{
+		Recipient:   contact.ID,
+		Payload:     marshalled,
+		MessageType: message.XxMessage,
+	}
+
+	rids, mid, t, err := cl.SendE2E(resp, params.GetDefaultE2E())
+	if err != nil {
+		return errors.WithMessage(err, "Failed to send message")
+	}
+	jww.INFO.Printf("Sent welcome [%+v] to %+v on rounds %+v [%+v]", mid, requestor, rids, t)
+	return nil
+}
+
+// initStorage connects to the databases described in the config.  If the
+// database is required, failing to connect is fatal rather than falling back
+// to a map backend whose changes are lost on exit, as commands managing the
+// bot's data must not report success for changes which were never stored.
+func initStorage(requireDatabase bool) *storage.Storage {
+	// Get database parameters
+	rawAddr := viper.GetString("dbAddress")
+	var addr, port string
+	var err error
+	if rawAddr != "" {
+		addr, port, err = net.SplitHostPort(rawAddr)
+		if err != nil {
+			jww.FATAL.Panicf("Unable to get database port from %s: %+v", rawAddr, err)
+		}
+	}
+
+	udRawAddr := viper.GetString("udbDbAddress")
+	var udAddr, udPort string
+	if udRawAddr != "" {
+		udAddr, udPort, err = net.SplitHostPort(udRawAddr)
+		if err != nil {
+			jww.FATAL.Panicf("Unable to get database port from %s: %+v", udRawAddr, err)
+		}
+	}
+
+	sp := storage.Params{
+		Username: viper.GetString("dbUsername"),
+		Password: viper.GetString("dbPassword"),
+		DBName:   viper.GetString("dbName"),
+		Address:  addr,
+		Port:     port,
+	}
+	udbParams := storage.Params{
+		Username: viper.GetString("UdDbUsername"),
+		Password: viper.GetString("UdDbPassword"),
+		DBName:   viper.GetString("UdDbName"),
+		Address:  udAddr,
+		Port:     udPort,
+	}
+
+	config := storage.Config{
+		Lockout: storage.LockoutParams{
+			MaxAttempts: viper.GetInt("lockoutAttempts"),
+			Window:      viper.GetDuration("lockoutWindow"),
+			Duration:    viper.GetDuration("lockoutDuration"),
+		},
+		Velocity: storage.VelocityParams{
+			MaxPerHour: viper.GetInt("velocityMaxPerHour"),
+			MaxPerDay:  viper.GetInt("velocityMaxPerDay"),
+		},
+		OwnCodeRequiresRegistration: viper.GetBool("ownCodeRequiresRegistration"),
+		Digest: storage.DigestParams{
+			Threshold: viper.GetInt("digestThreshold"),
+			Window:    viper.GetDuration("digestWindow"),
+		},
+		RequireDatabase: requireDatabase,
+	}
+
+	err = viper.UnmarshalKey("campaigns", &config.Campaigns)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to parse campaigns: %+v", err)
+	}
+
+	// Campaign reward settings predating the rules engine only apply when
+	// no rules file replaces them
+	rulesPath := viper.GetString("rulesPath")
+	if legacy := storage.LegacyRules(config.Campaigns); legacy == nil {
+		config.Rules, err = rules.NewEngine(rulesPath)
+	} else if rulesPath != "" {
+		jww.ERROR.Printf("Ignoring the tiers, milestones & refereeReward "+
+			"settings of campaigns, which are replaced by the rules in %s", rulesPath)
+		config.Rules, err = rules.NewEngine(rulesPath)
+	} else {
+		jww.WARN.Printf("The tiers, milestones & refereeReward settings of " +
+			"campaigns are deprecated, move them to a rules file")
+		config.Rules, err = rules.NewStaticEngine(legacy)
+	}
+	if err != nil {
+		jww.FATAL.Panicf("Failed to load rules: %+v", err)
+	}
+
+	err = viper.UnmarshalKey("welcome", &config.Welcome)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to parse welcome flow: %+v", err)
+	}
+	config.WelcomeCampaign = viper.GetString("welcomeCampaign")
+	config.CodeChangeWindow = viper.GetDuration("codeChangeWindow")
+
+	config.Catalog, err = catalog.New(viper.GetString("localesPath"))
+	if err != nil {
+		jww.FATAL.Panicf("Failed to load message catalog: %+v", err)
+	}
+
+	s, err := storage.NewStorage(sp, udbParams, config)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to initialize storage interface: %+v", err)
+	}
+	return s
+}
+
 // Execute calls the root command
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
@@ -231,7 +377,7 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&cfgFile, "config", "c", "",
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "",
 		"Path to load the configuration file from. If not set, this "+
 			"file must be named config.yaml and must be located in "+
 			"~/.xxnetwork/, /opt/xxnetwork, or /etc/xxnetwork.")
@@ -260,6 +406,19 @@ func initConfig() {
 	}
 }
 
+// getAdmins parses the base64 encoded admin user IDs from the config
+func getAdmins() []*id.ID {
+	var admins []*id.ID
+	for _, raw := range viper.GetStringSlice("admins") {
+		admin, err := storage.ParseUserID(raw)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse admin ID %s: %+v", raw, err)
+		}
+		admins = append(admins, admin)
+	}
+	return admins
+}
+
 // initLog initializes logging thresholds and the log path.
 func initLog() {
 	vipLogLevel := viper.GetUint("logLevel")
@@ -0,0 +1,115 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+	"time"
+)
+
+var (
+	rulesPath string
+	testCode  string
+	testUses  int
+	testTime  string
+)
+
+// rulesCmd groups the commands for working with reward rules
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "Work with the rules determining registration rewards",
+}
+
+// rulesTestCmd evaluates the rules against a hypothetical registration
+var rulesTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Show the outcome of the rules for a registration, without recording anything",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		path := rulesPath
+		if path == "" {
+			path = viper.GetString("rulesPath")
+		}
+		rs, err := configuredRules(path)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to load rules: %+v", err)
+		}
+
+		r := rules.Registration{
+			Code:     testCode,
+			Campaign: campaign,
+			Tags:     tags,
+			Uses:     testUses,
+			Time:     time.Now(),
+		}
+		if testTime != "" {
+			r.Time, err = rules.ParseDate(testTime)
+			if err != nil {
+				jww.FATAL.Panicf("Invalid time %s: %+v", testTime, err)
+			}
+		}
+
+		o := rs.Evaluate(r)
+		for _, name := range o.Fired {
+			fmt.Printf("fired\t%s\n", name)
+		}
+		for _, c := range o.Credits {
+			fmt.Printf("credit\t%s\ttier %d\t%d\t%s\n", c.To, c.Tier, c.Amount, c.Rule)
+		}
+		for _, m := range o.Milestones {
+			fmt.Printf("milestone\t%d uses\t%d\t%s\n", m.Uses, m.Bonus, m.Rule)
+		}
+		if o.Reject {
+			fmt.Printf("reject\t%s\n", o.Message)
+		} else if o.Hold {
+			fmt.Printf("hold\t%s\n", o.Message)
+		}
+	},
+}
+
+// configuredRules returns the rules in the file at path.  Without a file, the
+// deprecated reward settings of campaigns are translated into rules if set,
+// & the default rules are used otherwise.
+func configuredRules(path string) (*rules.RuleSet, error) {
+	if path != "" {
+		return rules.Load(path)
+	}
+	var campaigns map[string]storage.Campaign
+	err := viper.UnmarshalKey("campaigns", &campaigns)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to parse campaigns")
+	}
+	if legacy := storage.LegacyRules(campaigns); legacy != nil {
+		return legacy, nil
+	}
+	return rules.Default(), nil
+}
+
+func init() {
+	rulesTestCmd.Flags().StringVar(&rulesPath, "rules", "",
+		"Rules file to evaluate, defaults to the configured rulesPath.")
+	rulesTestCmd.Flags().StringVar(&testCode, "code", "",
+		"Code used to register.")
+	rulesTestCmd.Flags().StringVar(&campaign, "campaign", "",
+		"Campaign of the code.")
+	rulesTestCmd.Flags().StringSliceVar(&tags, "tags", nil,
+		"Tags of the code.")
+	rulesTestCmd.Flags().IntVar(&testUses, "uses", 1,
+		"Approved uses of the code, including this registration.")
+	rulesTestCmd.Flags().StringVar(&testTime, "time", "",
+		"Date of the registration as YYYY-MM-DD, defaults to now.")
+
+	rulesCmd.AddCommand(rulesTestCmd)
+	rootCmd.AddCommand(rulesCmd)
+}
@@ -0,0 +1,85 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+	"sort"
+)
+
+var (
+	proposedRulesPath string
+	simulateSince     string
+)
+
+// simulateRulesCmd compares the rewards of a new rules file against the
+// current rules over past registrations
+var simulateRulesCmd = &cobra.Command{
+	Use:   "simulate-rules",
+	Short: "Show how the rewards of past registrations would change under new rules",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := rules.ParseDate(simulateSince)
+		if err != nil {
+			jww.FATAL.Panicf("Invalid date %s: %+v", simulateSince, err)
+		}
+
+		current, err := configuredRules(viper.GetString("rulesPath"))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to load current rules: %+v", err)
+		}
+		proposed, err := rules.Load(proposedRulesPath)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to load proposed rules: %+v", err)
+		}
+
+		sim, err := initStorage(true).SimulateRules(current, proposed, since)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to simulate rules: %+v", err)
+		}
+
+		var codes []string
+		for code := range sim.Current.Codes {
+			codes = append(codes, code)
+		}
+		for code := range sim.Proposed.Codes {
+			if _, ok := sim.Current.Codes[code]; !ok {
+				codes = append(codes, code)
+			}
+		}
+		sort.Strings(codes)
+
+		fmt.Printf("code\tcurrent\tproposed\tdifference\n")
+		for _, code := range codes {
+			cur, prop := sim.Current.Codes[code], sim.Proposed.Codes[code]
+			fmt.Printf("%s\t%d\t%d\t%+d\n", code, cur, prop, prop-cur)
+		}
+		fmt.Printf("referees\t%d\t%d\t%+d\n", sim.Current.Referees,
+			sim.Proposed.Referees, sim.Proposed.Referees-sim.Current.Referees)
+		fmt.Printf("total\t%d\t%d\t%+d\n", sim.Current.Total(),
+			sim.Proposed.Total(), sim.Proposed.Total()-sim.Current.Total())
+		fmt.Printf("\n%d registrations replayed; held %d -> %d, rejected %d -> %d\n",
+			sim.Registrations, sim.Current.Held, sim.Proposed.Held,
+			sim.Current.Rejected, sim.Proposed.Rejected)
+	},
+}
+
+func init() {
+	simulateRulesCmd.Flags().StringVar(&proposedRulesPath, "rules", "",
+		"Rules file to compare against the current rules.")
+	simulateRulesCmd.Flags().StringVar(&simulateSince, "since", "",
+		"Replay registrations made on or after this date, as YYYY-MM-DD.")
+	simulateRulesCmd.MarkFlagRequired("rules")
+	simulateRulesCmd.MarkFlagRequired("since")
+
+	rootCmd.AddCommand(simulateRulesCmd)
+}
@@ -0,0 +1,45 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// welcomeReportCmd compares how the welcome variants convert
+var welcomeReportCmd = &cobra.Command{
+	Use:   "welcome-report",
+	Short: "Show how many users sent each welcome variant submitted a code and registered",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		stats, err := initStorage(true).GetWelcomeStats()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get welcome stats: %+v", err)
+		}
+		fmt.Printf("campaign\tvariant\tassigned\tsubmitted\tregistered\n")
+		for _, ws := range stats {
+			fmt.Printf("%s\t%s\t%d\t%d (%.1f%%)\t%d (%.1f%%)\n", ws.Campaign, ws.Variant,
+				ws.Assigned, ws.Submitted, percent(ws.Submitted, ws.Assigned),
+				ws.Registered, percent(ws.Registered, ws.Assigned))
+		}
+	},
+}
+
+// percent returns n as a percentage of total
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+func init() {
+	rootCmd.AddCommand(welcomeReportCmd)
+}
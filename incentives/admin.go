@@ -0,0 +1,233 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"fmt"
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"strings"
+)
+
+// isAdmin returns whether the sender is one of the configured admins
+func (l *listener) isAdmin(sender *id.ID) bool {
+	for _, admin := range l.admins {
+		if admin.Cmp(sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAdminRouter returns a router with the commands available to admins
+func newAdminRouter() *router {
+	r := &router{commands: map[string]*command{}, helpText: "admin.help"}
+	r.register(&command{
+		name: "admin",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.adminRouter.help(l, uid)
+		},
+	})
+	r.register(&command{
+		name:    "codestats",
+		usage:   "<code>",
+		minArgs: 1,
+		maxArgs: 1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.codeStats(args[0])
+		},
+	})
+	r.register(&command{
+		name:    "block",
+		usage:   "<user|code> <target> [reason]",
+		minArgs: 2,
+		maxArgs: -1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setBlocked(true, args[0], args[1], strings.Join(args[2:], " "))
+		},
+	})
+	r.register(&command{
+		name:    "unblock",
+		usage:   "<user|code> <target>",
+		minArgs: 2,
+		maxArgs: 2,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setBlocked(false, args[0], args[1], "")
+		},
+	})
+	r.register(&command{
+		name:    "disable",
+		usage:   "<code> [reason]",
+		minArgs: 1,
+		maxArgs: -1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setBlocked(true, "code", args[0], strings.Join(args[1:], " "))
+		},
+	})
+	r.register(&command{
+		name:    "prefs",
+		usage:   "<userID> [notifications=<all|digest|none>] [language=<language>]",
+		minArgs: 1,
+		maxArgs: 3,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.preferences(args[0], args[1:])
+		},
+	})
+	r.register(&command{
+		name:    "reverse",
+		usage:   "<userID> [--notify] <reason>",
+		minArgs: 2,
+		maxArgs: -1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.reverse(args[0], args[1:])
+		},
+	})
+	r.register(&command{
+		name:    "broadcast",
+		usage:   "[campaign=<name>] [status=<status>] <text>",
+		minArgs: 1,
+		maxArgs: -1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.broadcast(args)
+		},
+	})
+	return r
+}
+
+// handleAdmin runs an admin command sent by an admin, recording it in the
+// audit log.  Returns the response and whether the text was an admin command.
+func (l *listener) handleAdmin(sender *id.ID, text string) (string, bool) {
+	cmd, args, ok := l.adminRouter.lookup(text)
+	if !ok {
+		return "", false
+	}
+	strResponse := l.adminRouter.run(l, sender, cmd, args)
+	l.s.RecordAdminAction(sender.String(), text, strResponse)
+	return strResponse, true
+}
+
+// broadcast starts a broadcast to the segment given by any leading
+// campaign= & status= arguments, with the remaining arguments as the text
+func (l *listener) broadcast(args []string) string {
+	var seg storage.Segment
+	for len(args) > 0 {
+		if v := strings.TrimPrefix(args[0], "campaign="); v != args[0] {
+			seg.Campaign = v
+		} else if v := strings.TrimPrefix(args[0], "status="); v != args[0] {
+			seg.Status = strings.ToLower(v)
+		} else {
+			break
+		}
+		args = args[1:]
+	}
+
+	b, err := l.s.CreateBroadcast(strings.Join(args, " "), seg)
+	if err != nil {
+		return fmt.Sprintf("Failed to broadcast: %+v", err)
+	}
+	return fmt.Sprintf("Started broadcast %d to %d users", b.ID, b.Recipients)
+}
+
+// reverse reverses the registration for the reason, notifying the user if the
+// reason is preceded by --notify
+func (l *listener) reverse(uid string, args []string) string {
+	notify := args[0] == "--notify"
+	if notify {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return "A reason is required to reverse a registration"
+	}
+	err := l.s.ReverseRegistration(uid, strings.Join(args, " "), notify)
+	if err != nil {
+		return fmt.Sprintf("Failed to reverse registration %s: %+v", uid, err)
+	}
+	return fmt.Sprintf("Reversed registration %s", uid)
+}
+
+// preferences applies any notifications= & language= settings to the user's
+// preferences, then describes them
+func (l *listener) preferences(uid string, settings []string) string {
+	for _, setting := range settings {
+		var err error
+		if v := strings.TrimPrefix(setting, "notifications="); v != setting {
+			err = l.s.SetNotifications(uid, strings.ToLower(v))
+		} else if v := strings.TrimPrefix(setting, "language="); v != setting {
+			err = l.s.SetLanguage(uid, v)
+		} else {
+			err = fmt.Errorf("unknown setting %q", setting)
+		}
+		if err != nil {
+			return fmt.Sprintf("Failed to update preferences of %s: %+v", uid, err)
+		}
+	}
+
+	p, err := l.s.GetPreferences(uid)
+	if err != nil {
+		return fmt.Sprintf("Failed to get preferences of %s: %+v", uid, err)
+	}
+	language := p.Language
+	if language == "" {
+		language = "default"
+	}
+	return fmt.Sprintf("Preferences of %s: notifications %s, language %s",
+		uid, p.Notifications, language)
+}
+
+// codeStats describes the usage & rewards of a code
+func (l *listener) codeStats(code string) string {
+	c, err := l.s.GetCode(code)
+	if err != nil {
+		return fmt.Sprintf("Failed to get code %s: %+v", code, err)
+	}
+	strResponse := fmt.Sprintf("Code %s: %d uses, %d credited", c.Code, c.Uses, c.Total)
+	if c.Campaign != "" {
+		strResponse += fmt.Sprintf(", campaign %s", c.Campaign)
+	}
+	if c.OwnerID != "" {
+		strResponse += fmt.Sprintf(", owned by %s", c.OwnerID)
+	}
+	if c.Held {
+		strResponse += ", held for review"
+	}
+	if blocked, err := l.s.CheckBlockedCode(code); err == nil && blocked {
+		strResponse += ", blocked"
+	}
+	return strResponse
+}
+
+// setBlocked adds a user or code to the blocklist or removes it
+func (l *listener) setBlocked(block bool, kind, target, reason string) string {
+	action := "unblock"
+	if block {
+		action = "block"
+	}
+
+	var err error
+	switch strings.ToLower(kind) {
+	case "user":
+		if block {
+			err = l.s.BlockUser(target, reason)
+		} else {
+			err = l.s.UnblockUser(target)
+		}
+	case "code":
+		if block {
+			err = l.s.BlockCode(target, reason)
+		} else {
+			err = l.s.UnblockCode(target)
+		}
+	default:
+		return fmt.Sprintf("Can only %s a user or code", action)
+	}
+
+	if err != nil {
+		return fmt.Sprintf("Failed to %s %s %s: %+v", action, kind, target, err)
+	}
+	return fmt.Sprintf("Done: %sed %s %s", action, kind, target)
+}
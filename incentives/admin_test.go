@@ -0,0 +1,62 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+)
+
+// queuedTo returns the number of messages queued to the recipient
+func queuedTo(t *testing.T, l *listener, recipient *id.ID) int {
+	t.Helper()
+	messages, err := l.s.GetQueuedMessages(100)
+	if err != nil {
+		t.Fatalf("Failed to get queued messages: %+v", err)
+	}
+	n := 0
+	for _, m := range messages {
+		if m.Recipient == recipient.String() {
+			n++
+		}
+	}
+	return n
+}
+
+// Tests that admins reversing a registration only notify the user when
+// asked to, & must give a reason
+func TestListener_reverse(t *testing.T) {
+	admin := id.NewIdFromString("admin", id.User, t)
+	l := newTestListener(t, admin, storage.Config{})
+	l.adminRouter = newAdminRouter()
+	quiet := id.NewIdFromString("quiet", id.User, t)
+	told := id.NewIdFromString("told", id.User, t)
+	l.s.Register(quiet, "CODE")
+	l.s.Register(told, "CODE")
+
+	l.adminRouter.route(l, admin, "reverse "+told.String()+" --notify")
+	if u, err := l.s.GetUser(told.String()); err != nil || u.Status != storage.StatusApproved {
+		t.Fatalf("Registration was reversed without a reason: %+v, %v", u, err)
+	}
+
+	l.adminRouter.route(l, admin, "reverse "+quiet.String()+" fraud")
+	l.adminRouter.route(l, admin, "reverse "+told.String()+" --notify fraud")
+	for uid, expected := range map[*id.ID]int{quiet: 0, told: 1} {
+		u, err := l.s.GetUser(uid.String())
+		if err != nil {
+			t.Fatalf("Failed to get user: %+v", err)
+		}
+		if u.Status != storage.StatusReversed {
+			t.Errorf("Registration is %s, expected %s", u.Status, storage.StatusReversed)
+		}
+		if n := queuedTo(t, l, uid); n != expected {
+			t.Errorf("%d messages were queued to the user, expected %d", n, expected)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles dispatching messages from users to the bot's commands
+
+package incentives
+
+import (
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"strings"
+)
+
+// handler runs a command for the sending user with the words following the
+// command name.  Returns the response string.
+type handler func(l *listener, uid *id.ID, args []string) string
+
+// command is a word users can send to the bot to run a handler.  Its
+// description shown in help is the text "command.<name>" in the catalog.
+type command struct {
+	name string
+	// Arguments shown in help, e.g. "<all|digest|off>"
+	usage string
+	// Range of argument counts accepted; a negative maximum is unlimited
+	minArgs int
+	maxArgs int
+	run     handler
+}
+
+// router dispatches messages to the command named by their first word,
+// treating anything else as a referral code
+type router struct {
+	commands map[string]*command
+	// Names of the commands in the order registered, for help
+	names []string
+	// Catalog text introducing the list of commands in help
+	helpText string
+}
+
+// newRouter returns a router with the user commands registered
+func newRouter() *router {
+	r := &router{commands: map[string]*command{}, helpText: "help"}
+	r.register(&command{
+		name: "help",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.router.help(l, uid)
+		},
+	})
+	r.register(&command{
+		name: "status",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.status(uid)
+		},
+	})
+	r.register(&command{
+		name:    "change",
+		usage:   "<code>",
+		minArgs: 1,
+		maxArgs: 1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.changeCode(uid, args[0])
+		},
+	})
+	r.register(&command{
+		name: "mycode",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.s.IssueCode(uid)
+		},
+	})
+	r.register(&command{
+		name: "stats",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.s.CodeStats(uid)
+		},
+	})
+	r.register(&command{
+		name: "payout",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.payout(uid)
+		},
+	})
+	r.register(&command{
+		name:    "notify",
+		usage:   "<all|digest|off>",
+		minArgs: 1,
+		maxArgs: 1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setNotifications(uid, strings.ToLower(args[0]))
+		},
+	})
+	r.register(&command{
+		name: "stop",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setNotifications(uid, "off")
+		},
+	})
+	r.register(&command{
+		name: "start",
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setNotifications(uid, storage.NotifyAll)
+		},
+	})
+	r.register(&command{
+		name:    "lang",
+		usage:   "<language>",
+		minArgs: 1,
+		maxArgs: 1,
+		run: func(l *listener, uid *id.ID, args []string) string {
+			return l.setLanguage(uid, args[0])
+		},
+	})
+	return r
+}
+
+// register adds a command to the router, replacing any of the same name
+func (r *router) register(cmd *command) {
+	if _, ok := r.commands[cmd.name]; !ok {
+		r.names = append(r.names, cmd.name)
+	}
+	r.commands[cmd.name] = cmd
+}
+
+// lookup returns the command named by the first word of the text & the
+// remaining words, or false if there is no such command
+func (r *router) lookup(text string) (*command, []string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, nil, false
+	}
+	cmd, ok := r.commands[strings.ToLower(fields[0])]
+	return cmd, fields[1:], ok
+}
+
+// route runs the command named by the text for the user, falling back to
+// using the text as a code.  Answers outside of a confirmation are not codes,
+// so do not count towards a lockout.  Returns the response string.
+func (r *router) route(l *listener, uid *id.ID, text string) string {
+	cmd, args, ok := r.lookup(text)
+	if !ok && isAnswer(text) {
+		return l.s.Text(uid.String(), "confirm.none", nil)
+	} else if !ok {
+		return l.useCode(uid, text)
+	}
+	return r.run(l, uid, cmd, args)
+}
+
+// run checks the number of arguments & runs the command.  Returns the
+// response string.
+func (r *router) run(l *listener, uid *id.ID, cmd *command, args []string) string {
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return l.s.Text(uid.String(), "usage", catalog.Data{"Signature": cmd.signature()})
+	}
+	return cmd.run(l, uid, args)
+}
+
+// help lists the registered commands in the user's language
+func (r *router) help(l *listener, uid *id.ID) string {
+	var commands []catalog.Data
+	for _, name := range r.names {
+		commands = append(commands, catalog.Data{
+			"Signature": r.commands[name].signature(),
+			"Help":      l.s.Text(uid.String(), "command."+name, nil),
+		})
+	}
+	return l.s.Text(uid.String(), r.helpText, catalog.Data{"Commands": commands})
+}
+
+// signature returns the command name followed by its usage
+func (cmd *command) signature() string {
+	if cmd.usage == "" {
+		return cmd.name
+	}
+	return cmd.name + " " + cmd.usage
+}
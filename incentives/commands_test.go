@@ -0,0 +1,71 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestListener returns a listener over map backed storage in which the
+// user owns the code CODE
+func newTestListener(t *testing.T, uid *id.ID, config storage.Config) *listener {
+	s, err := storage.NewStorage(storage.Params{}, storage.Params{}, config)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	err = s.CreateCode("CODE", "", uid.String(), "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create code: %+v", err)
+	}
+	return &listener{s: s, router: newRouter(), conversationTTL: time.Minute}
+}
+
+// Tests that messages run the command named by their first word in any case,
+// that argument counts are checked, & that other messages are used as codes
+func TestRouter_route(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{})
+	uid := id.NewIdFromString("user", id.User, t)
+
+	expected := "You do not have a referral code yet.  Send \"mycode\" to get one."
+	if strResponse := l.router.route(l, uid, "  STATS "); strResponse != expected {
+		t.Errorf("Expected response %q, got %q", expected, strResponse)
+	}
+
+	expected = "Usage: notify <all|digest|off>"
+	for _, text := range []string{"notify", "notify all off"} {
+		if strResponse := l.router.route(l, uid, text); strResponse != expected {
+			t.Errorf("Expected response %q to %q, got %q", expected, text, strResponse)
+		}
+	}
+
+	l.router.route(l, uid, "CODE")
+	if u, err := l.s.GetUser(uid.String()); err != nil || u.Code != "CODE" {
+		t.Errorf("User did not register with CODE: %+v, %v", u, err)
+	}
+}
+
+// Tests that help lists every command with its usage
+func TestRouter_help(t *testing.T) {
+	uid := id.NewIdFromString("user", id.User, t)
+	l := newTestListener(t, uid, storage.Config{})
+
+	strResponse := l.router.route(l, uid, "help")
+	for _, name := range l.router.names {
+		if !strings.Contains(strResponse, l.router.commands[name].signature()) {
+			t.Errorf("Help does not list %s: %q", name, strResponse)
+		}
+	}
+	if !strings.Contains(strResponse, "notify <all|digest|off>") {
+		t.Errorf("Help does not show the usage of notify: %q", strResponse)
+	}
+}
@@ -0,0 +1,235 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles multi-step conversations with users.  A conversation is a state,
+// persisted in storage with an expiry so it survives restarts, whose handler
+// receives the user's next message & picks the following state.
+
+package incentives
+
+import (
+	"encoding/json"
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// Actions confirmed in stateConfirm
+const (
+	// Register with the code in the "code" value
+	actionUseCode = "useCode"
+	// Change the code registered with to the code in the "code" value
+	actionChangeCode = "changeCode"
+)
+
+// Conversation states
+const (
+	// Waiting for YES or NO to the action in the "action" value
+	stateConfirm = "confirm"
+	// Waiting for the wallet address to pay the user's code rewards to
+	statePayoutAddress = "payoutAddress"
+)
+
+// Length range of wallet addresses, which are SS58 encodings of a 32 byte key
+// with a one byte network prefix
+const (
+	addressMinLength = 47
+	addressMaxLength = 48
+)
+
+// Characters of the base58 encoding used by wallet addresses
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// step is the outcome of handling a message in a conversation
+type step struct {
+	Response string
+	// State to move to, or empty to end the conversation
+	Next string
+	// Values carried to the next state
+	Data map[string]string
+}
+
+// stateHandler handles the user's message in a conversation state.  Returns
+// false if the message is not part of the conversation, which ends it & lets
+// the message be handled normally.
+type stateHandler func(l *listener, uid *id.ID, text string, data map[string]string) (step, bool)
+
+// confirmAction runs an action once the user confirms it.  Returns the
+// response string.
+type confirmAction func(l *listener, uid *id.ID, data map[string]string) string
+
+// states holds the handler of each conversation state
+var states = map[string]stateHandler{
+	stateConfirm:       handleConfirm,
+	statePayoutAddress: handlePayoutAddress,
+}
+
+// confirmActions holds the actions which may be confirmed in stateConfirm
+var confirmActions = map[string]confirmAction{
+	actionUseCode: func(l *listener, uid *id.ID, data map[string]string) string {
+		return l.s.Register(uid, data["code"])
+	},
+	actionChangeCode: func(l *listener, uid *id.ID, data map[string]string) string {
+		return l.s.ChangeCode(uid, data["code"])
+	},
+}
+
+// converse passes the text to the user's conversation, if they are in one
+// that has not expired.  Returns the response and whether the text was
+// handled.
+func (l *listener) converse(uid *id.ID, text string) (string, bool) {
+	c, err := l.s.GetConversation(uid.String())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", false
+	} else if err != nil {
+		jww.ERROR.Printf("Failed to get conversation with %s: %+v", uid, err)
+		return "", false
+	}
+
+	handler, ok := states[c.State]
+	if !ok {
+		l.endConversation(uid)
+		return "", false
+	} else if time.Now().After(c.ExpiresAt) {
+		l.endConversation(uid)
+		// Late answers to a confirmation must not be taken as codes
+		if c.State == stateConfirm && isAnswer(text) {
+			return l.s.Text(uid.String(), "confirm.expired", nil), true
+		}
+		return "", false
+	}
+
+	data := map[string]string{}
+	if c.Data != "" {
+		err = json.Unmarshal([]byte(c.Data), &data)
+		if err != nil {
+			jww.ERROR.Printf("Invalid data in conversation with %s: %+v", uid, err)
+			l.endConversation(uid)
+			return "", false
+		}
+	}
+
+	st, ok := handler(l, uid, text, data)
+	if !ok || st.Next == "" {
+		l.endConversation(uid)
+	} else {
+		l.startConversation(uid, st.Next, st.Data)
+	}
+	return st.Response, ok
+}
+
+// startConversation moves the user into the state, replacing any conversation
+// they were in
+func (l *listener) startConversation(uid *id.ID, state string, data map[string]string) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		jww.ERROR.Printf("Failed to encode conversation data for %s: %+v", uid, err)
+		return
+	}
+	err = l.s.UpsertConversation(&storage.Conversation{
+		UserID:    uid.String(),
+		State:     state,
+		Data:      string(encoded),
+		ExpiresAt: time.Now().Add(l.conversationTTL),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to save conversation with %s: %+v", uid, err)
+	}
+}
+
+// endConversation removes the user's conversation state
+func (l *listener) endConversation(uid *id.ID) {
+	err := l.s.DeleteConversation(uid.String())
+	if err != nil {
+		jww.ERROR.Printf("Failed to end conversation with %s: %+v", uid, err)
+	}
+}
+
+// handleConfirm runs the pending action if the user replies YES & drops it
+// if they reply NO
+func handleConfirm(l *listener, uid *id.ID, text string, data map[string]string) (step, bool) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "yes", "y":
+		action, ok := confirmActions[data["action"]]
+		if !ok {
+			return step{}, false
+		}
+		return step{Response: action(l, uid, data)}, true
+	case "no", "n", "cancel":
+		return step{Response: l.s.Text(uid.String(), "conversation.cancelled", nil)}, true
+	default:
+		return step{}, false
+	}
+}
+
+// isAnswer returns whether the text is a reply to a YES/NO question
+func isAnswer(text string) bool {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "yes", "y", "no", "n":
+		return true
+	}
+	return false
+}
+
+// handlePayoutAddress sets the next message as the payout address of the
+// user's code.  Messages too short to be an address, such as commands, codes
+// & answers, are not part of the conversation; longer words which are not
+// valid addresses are asked for again.
+func handlePayoutAddress(l *listener, uid *id.ID, text string, data map[string]string) (step, bool) {
+	fields := strings.Fields(text)
+	if len(fields) != 1 {
+		return step{}, false
+	} else if strings.EqualFold(fields[0], "cancel") {
+		return step{Response: l.s.Text(uid.String(), "conversation.cancelled", nil)}, true
+	} else if len(fields[0]) < addressMinLength {
+		return step{}, false
+	} else if !isAddress(fields[0]) {
+		return step{
+			Response: l.s.Text(uid.String(), "payout.invalid", catalog.Data{"Address": fields[0]}),
+			Next:     statePayoutAddress,
+		}, true
+	}
+
+	code, err := l.s.SetPayoutAddress(uid.String(), fields[0])
+	if err != nil {
+		return step{Response: l.s.Text(uid.String(), "payout.error",
+			catalog.Data{"Error": err})}, true
+	}
+	return step{Response: l.s.Text(uid.String(), "payout.set",
+		catalog.Data{"Code": code, "Address": fields[0]})}, true
+}
+
+// isAddress returns whether the text is formatted as a wallet address
+func isAddress(text string) bool {
+	if len(text) < addressMinLength || len(text) > addressMaxLength {
+		return false
+	}
+	for _, r := range text {
+		if !strings.ContainsRune(base58Alphabet, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// payout starts the conversation setting the payout address of the user's
+// code.  Returns the response string.
+func (l *listener) payout(uid *id.ID) string {
+	_, err := l.s.GetOwnedCode(uid.String())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return l.s.Text(uid.String(), "stats.none", nil)
+	} else if err != nil {
+		return l.s.Text(uid.String(), "mycode.lookupError", catalog.Data{"Error": err})
+	}
+	l.startConversation(uid, statePayoutAddress, nil)
+	return l.s.Text(uid.String(), "payout.prompt", nil)
+}
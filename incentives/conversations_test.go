@@ -0,0 +1,213 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// A validly formatted wallet address
+const testAddress = "6a7Xs3PtjdTBJFk9w2W6M4ExeATcjDrPWrZdqJrTUVvUK4GZ"
+
+// respond passes the text to the user's conversation, or routes it as a
+// command or code if it is not part of one, as the listener does
+func respond(l *listener, uid *id.ID, text string) string {
+	if strResponse, ok := l.converse(uid, text); ok {
+		return strResponse
+	}
+	return l.router.route(l, uid, text)
+}
+
+// checkRegistered fails the test unless the user is registered with CODE,
+// or is not registered if registered is false
+func checkRegistered(t *testing.T, l *listener, uid *id.ID, registered bool) {
+	t.Helper()
+	u, err := l.s.GetUser(uid.String())
+	if registered && (err != nil || u.Code != "CODE") {
+		t.Errorf("User is not registered with CODE: %+v, %v", u, err)
+	} else if !registered && !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("User was registered: %+v, %v", u, err)
+	}
+}
+
+// Tests that only base58 words of the length of an address are addresses
+func TestIsAddress(t *testing.T) {
+	tests := map[string]bool{
+		testAddress:                  true,
+		testAddress[:47]:             true,
+		testAddress[:46]:             false,
+		testAddress + "a":            false,
+		"0" + testAddress[1:]:        false,
+		"l" + testAddress[1:]:        false,
+		testAddress[:40] + "-_+/=ab": false,
+		"help":                       false,
+	}
+	for text, expected := range tests {
+		if got := isAddress(text); got != expected {
+			t.Errorf("isAddress(%q) returned %t, expected %t", text, got, expected)
+		}
+	}
+}
+
+// Tests that commands, answers & codes sent while the bot waits for a payout
+// address end the conversation without changing the address
+func TestListener_converse_PayoutAddressOtherMessages(t *testing.T) {
+	uid := id.NewIdFromString("user", id.User, t)
+	l := newTestListener(t, uid, storage.Config{})
+
+	for _, text := range []string{"stop", "help", "status", "no", "n", "ABCD2345", "notify off"} {
+		l.payout(uid)
+		if _, ok := l.converse(uid, text); ok {
+			t.Errorf("%q was handled as a payout address", text)
+		}
+		if _, err := l.s.GetConversation(uid.String()); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("Conversation did not end after %q: %v", text, err)
+		}
+	}
+
+	c, err := l.s.GetCode("CODE")
+	if err != nil {
+		t.Fatalf("Failed to get code: %+v", err)
+	}
+	if c.PayoutAddress != "" {
+		t.Errorf("Payout address was set to %q", c.PayoutAddress)
+	}
+}
+
+// Tests that invalid addresses are asked for again & valid ones are set
+func TestListener_converse_PayoutAddress(t *testing.T) {
+	uid := id.NewIdFromString("user", id.User, t)
+	l := newTestListener(t, uid, storage.Config{})
+	l.payout(uid)
+
+	invalid := "0" + testAddress[1:]
+	if _, ok := l.converse(uid, invalid); !ok {
+		t.Fatal("Invalid address ended the conversation")
+	}
+	if c, err := l.s.GetConversation(uid.String()); err != nil || c.State != statePayoutAddress {
+		t.Fatalf("Bot is not waiting for the address after an invalid one: %+v, %v", c, err)
+	}
+
+	if _, ok := l.converse(uid, testAddress); !ok {
+		t.Fatal("Valid address was not handled")
+	}
+	c, err := l.s.GetCode("CODE")
+	if err != nil {
+		t.Fatalf("Failed to get code: %+v", err)
+	}
+	if c.PayoutAddress != testAddress {
+		t.Errorf("Expected payout address %s, got %q", testAddress, c.PayoutAddress)
+	}
+	if _, err = l.s.GetConversation(uid.String()); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Conversation did not end after the address was set: %v", err)
+	}
+}
+
+// Tests that code changes wait for the user to confirm them when codes must
+// be confirmed
+func TestListener_changeCode_Confirm(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{CodeChangeWindow: time.Hour})
+	l.confirmCodes = true
+	err := l.s.CreateCode("NEW", "", "", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create code: %+v", err)
+	}
+	uid := id.NewIdFromString("user", id.User, t)
+	l.s.Register(uid, "CODE")
+
+	l.router.route(l, uid, "change NEW")
+	u, err := l.s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if u.Code != "CODE" {
+		t.Fatalf("Code was changed to %s before the user confirmed", u.Code)
+	}
+	c, err := l.s.GetConversation(uid.String())
+	if err != nil || c.State != stateConfirm {
+		t.Fatalf("Bot is not waiting for confirmation: %+v, %v", c, err)
+	}
+
+	if _, ok := l.converse(uid, "yes"); !ok {
+		t.Fatal("Confirmation was not handled")
+	}
+	u, err = l.s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if u.Code != "NEW" {
+		t.Errorf("Code is %s after confirming the change, expected NEW", u.Code)
+	}
+}
+
+// Tests that codes are only used once the user confirms them when codes must
+// be confirmed
+func TestListener_useCode_Confirm(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{})
+	l.confirmCodes = true
+	uid := id.NewIdFromString("user", id.User, t)
+
+	respond(l, uid, "CODE")
+	checkRegistered(t, l, uid, false)
+	respond(l, uid, "no")
+	checkRegistered(t, l, uid, false)
+	if _, err := l.s.GetConversation(uid.String()); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Conversation did not end after the user declined: %v", err)
+	}
+
+	respond(l, uid, "CODE")
+	respond(l, uid, "YES")
+	checkRegistered(t, l, uid, true)
+}
+
+// Tests that answers sent after a confirmation expired, or without one, are
+// not taken as codes & do not count towards a lockout
+func TestListener_converse_LateAnswer(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{Lockout: storage.LockoutParams{
+		MaxAttempts: 1,
+		Window:      time.Hour,
+		Duration:    time.Hour,
+	}})
+	l.confirmCodes = true
+	l.conversationTTL = -time.Second
+	uid := id.NewIdFromString("user", id.User, t)
+
+	respond(l, uid, "CODE")
+	expected := l.s.Text(uid.String(), "confirm.expired", nil)
+	if strResponse := respond(l, uid, "yes"); strResponse != expected {
+		t.Errorf("Expected response %q, got %q", expected, strResponse)
+	}
+	expected = l.s.Text(uid.String(), "confirm.none", nil)
+	for _, text := range []string{"yes", "N"} {
+		if strResponse := respond(l, uid, text); strResponse != expected {
+			t.Errorf("Expected response %q to %q, got %q", expected, text, strResponse)
+		}
+	}
+	checkRegistered(t, l, uid, false)
+
+	attempts, err := l.s.GetAttemptsByResult(storage.AttemptInvalid, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get attempts: %+v", err)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("Answers were recorded as invalid codes: %+v", attempts)
+	}
+
+	l.conversationTTL = time.Minute
+	respond(l, uid, "CODE")
+	respond(l, uid, "yes")
+	checkRegistered(t, l, uid, true)
+}
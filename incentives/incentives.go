@@ -10,19 +10,75 @@ package incentives
 import (
 	"git.xx.network/elixxir/incentives-bot/storage"
 	"gitlab.com/elixxir/client/api"
+	"gitlab.com/xx_network/primitives/id"
+	"net/http"
+	"time"
 )
 
 // Impl struct wraps the listener for coupons
 type Impl struct {
 	*listener
+	sender *sender
+	stop   chan struct{}
+}
+
+// Params for configuring the incentives bot
+type Params struct {
+	RateLimit RateLimitParams
+	// IDs of the users allowed to run admin commands & sent admin alerts
+	Admins []*id.ID
+	// URL which alerts are posted to as JSON, if set
+	AlertWebhook string
+	// How often queued messages are checked for delivery
+	SendInterval time.Duration
+	// How often notices held for digests are sent
+	DigestInterval time.Duration
+	// Broadcasts are throttled to BroadcastBatchSize messages every
+	// BroadcastInterval
+	BroadcastBatchSize int
+	BroadcastInterval  time.Duration
+	// How long a multi-step conversation waits for the user's next message,
+	// including confirmation of a code
+	ConversationTTL time.Duration
+	// Ask users to confirm a code before registering with it
+	ConfirmCodes bool
 }
 
 // New initializes a listener with passed in storage and client
-func New(s *storage.Storage, c *api.Client) *Impl {
+func New(s *storage.Storage, c *api.Client, p Params) *Impl {
 	return &Impl{
-		&listener{
-			s: s,
-			c: c,
+		listener: &listener{
+			s:               s,
+			c:               c,
+			limiter:         newRateLimiter(p.RateLimit),
+			admins:          p.Admins,
+			router:          newRouter(),
+			adminRouter:     newAdminRouter(),
+			conversationTTL: p.ConversationTTL,
+			confirmCodes:    p.ConfirmCodes,
 		},
+		sender: &sender{
+			s:                  s,
+			c:                  c,
+			admins:             p.Admins,
+			webhook:            p.AlertWebhook,
+			interval:           p.SendInterval,
+			digestInterval:     p.DigestInterval,
+			broadcastBatchSize: p.BroadcastBatchSize,
+			broadcastInterval:  p.BroadcastInterval,
+			http:               &http.Client{Timeout: webhookTimeout},
+		},
+		stop: make(chan struct{}),
 	}
 }
+
+// Start delivering queued messages.  Must be called once the network
+// follower is running.
+func (i *Impl) Start() {
+	go i.sender.run(i.stop)
+}
+
+// Stop delivering queued messages
+func (i *Impl) Stop() {
+	close(i.stop)
+}
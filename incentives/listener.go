@@ -8,19 +8,32 @@
 package incentives
 
 import (
+	"git.xx.network/elixxir/incentives-bot/catalog"
 	"git.xx.network/elixxir/incentives-bot/storage"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/client/api"
 	"gitlab.com/elixxir/client/interfaces/message"
-	"gitlab.com/elixxir/client/interfaces/params"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"strings"
 	"time"
 )
 
 type listener struct {
-	delay time.Duration
-	s     *storage.Storage
-	c     *api.Client
+	delay   time.Duration
+	s       *storage.Storage
+	c       *api.Client
+	limiter *rateLimiter
+	admins  []*id.ID
+	router  *router
+	// Commands only admins may run
+	adminRouter *router
+	// How long a conversation waits for the user's next message
+	conversationTTL time.Duration
+	// Ask users to confirm codes before registering with them
+	confirmCodes bool
 }
 
 // Hear messages from users to the incentives bot & respond appropriately
@@ -31,6 +44,28 @@ func (l *listener) Hear(item message.Receive) {
 		return
 	}
 
+	// Drop messages from senders exceeding their rate limit, telling them
+	// once per limited period
+	if ok, wait, notify := l.limiter.allow(item.Sender); !ok {
+		jww.WARN.Printf("Rate limited message from %s", item.Sender)
+		if notify {
+			l.reply(item, l.s.Text(item.Sender.String(), "rateLimited",
+				catalog.Data{"Wait": wait.Truncate(time.Second) + time.Second}))
+		}
+		return
+	}
+
+	// Blocked users get a reply which does not reveal the block
+	if blocked, err := l.s.IsUserBlocked(item.Sender); err != nil {
+		jww.ERROR.Printf("Refusing message from %s: %+v", item.Sender, err)
+		l.reply(item, l.s.Text(item.Sender.String(), "register.checkError", catalog.Data{"Error": err}))
+		return
+	} else if blocked {
+		jww.INFO.Printf("Ignoring message from blocked user %s", item.Sender)
+		l.reply(item, l.s.Text(item.Sender.String(), "refused", nil))
+		return
+	}
+
 	// Parse the trigger
 	in := &CMIXText{}
 	var trigger string
@@ -45,37 +80,110 @@ func (l *listener) Hear(item message.Receive) {
 	jww.INFO.Printf("Received trigger %s [%+v]", trigger, in)
 	var strResponse string
 
+	// Messages from admins run admin commands, or go through the user flow
+	if l.isAdmin(item.Sender) {
+		if strResponse, ok := l.handleAdmin(item.Sender, trigger); ok {
+			l.reply(item, strResponse)
+			return
+		}
+	}
+
 	// PROCESSING
-	uid := item.Sender
-	strResponse = l.s.Register(uid, trigger)
-
-	// Respond to message
-	payload := &CMIXText{
-		Version: 0,
-		Text:    strResponse,
-		Reply: &TextReply{
-			MessageId: item.ID.Marshal(),
-			SenderId:  item.Sender.Marshal(),
-		},
-	}
-	marshalled, err := proto.Marshal(payload)
-	if err != nil {
-		jww.ERROR.Printf("Failed to marshal payload: %+v", err)
+	if strResponse, ok := l.converse(item.Sender, trigger); ok {
+		l.reply(item, strResponse)
 		return
 	}
-	// Create response message
-	resp := message.Send{
-		Recipient:   item.Sender,
-		Payload:     marshalled,
-		MessageType: message.XxMessage,
+	strResponse = l.router.route(l, item.Sender, trigger)
+
+	l.reply(item, strResponse)
+}
+
+// useCode registers the user with the code, or asks them to confirm it first
+// if codes must be confirmed.  Returns the response string.
+func (l *listener) useCode(uid *id.ID, code string) string {
+	if !l.confirmCodes {
+		return l.s.Register(uid, code)
+	}
+	strResponse, ok := l.s.PreviewCode(uid, code)
+	if ok {
+		l.startConversation(uid, stateConfirm, map[string]string{
+			"action": actionUseCode,
+			"code":   code,
+		})
 	}
+	return strResponse
+}
 
-	// Send response message to sender over cmix
-	rids, mid, t, err := l.c.SendE2E(resp, params.GetDefaultE2E())
+// changeCode changes the code the user registered with, or asks them to
+// confirm the change first if codes must be confirmed.  Returns the response
+// string.
+func (l *listener) changeCode(uid *id.ID, code string) string {
+	if !l.confirmCodes {
+		return l.s.ChangeCode(uid, code)
+	}
+	strResponse, ok := l.s.PreviewChange(uid, code)
+	if ok {
+		l.startConversation(uid, stateConfirm, map[string]string{
+			"action": actionChangeCode,
+			"code":   code,
+		})
+	}
+	return strResponse
+}
+
+// status describes the user's registration with incentives.  Returns the
+// response string.
+func (l *listener) status(uid *id.ID) string {
+	rs, err := l.s.GetRegistrationStatus(uid.String())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return l.s.Text(uid.String(), "status.none", nil)
+	} else if err != nil {
+		return l.s.Text(uid.String(), "status.error", catalog.Data{"Error": err})
+	}
+	data := catalog.Data{
+		"Code":   rs.Code,
+		"Status": rs.Status,
+		"Reward": rs.Reward,
+	}
+	// Registrations from before creation times were recorded have none
+	if !rs.CreatedAt.IsZero() {
+		data["Date"] = rs.CreatedAt.UTC().Format("2006-01-02")
+	}
+	return l.s.Text(uid.String(), "status", data)
+}
+
+// setNotifications updates which notices the user receives about their
+// referral codes.  Returns the response string.
+func (l *listener) setNotifications(uid *id.ID, setting string) string {
+	if setting == "off" {
+		setting = storage.NotifyNone
+	}
+	err := l.s.SetNotifications(uid.String(), setting)
 	if err != nil {
-		jww.ERROR.Printf("Failed to send message: %+v", err)
-	} else {
-		jww.INFO.Printf("Sent response %s [%+v] to %+v on rounds %+v [%+v]", strResponse, mid, item.Sender.String(), rids, t)
+		return l.s.Text(uid.String(), "notify.invalid", catalog.Data{"Error": err})
+	}
+	return l.s.Text(uid.String(), "notify.set", catalog.Data{"Setting": setting})
+}
+
+// setLanguage updates the language of the messages sent to the user.
+// Returns the response string, in the new language.
+func (l *listener) setLanguage(uid *id.ID, language string) string {
+	err := l.s.SetLanguage(uid.String(), language)
+	if err != nil {
+		return l.s.Text(uid.String(), "lang.invalid", catalog.Data{"Error": err})
+	}
+	return l.s.Text(uid.String(), "lang.set", catalog.Data{"Language": strings.ToLower(language)})
+}
+
+// reply sends a text response to a received message
+func (l *listener) reply(item message.Receive, strResponse string) {
+	reply := &TextReply{
+		MessageId: item.ID.Marshal(),
+		SenderId:  item.Sender.Marshal(),
+	}
+	err := sendText(l.c, item.Sender, strResponse, reply)
+	if err != nil {
+		jww.ERROR.Printf("Failed to respond to %s: %+v", item.Sender, err)
 	}
 }
 
@@ -0,0 +1,41 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"strings"
+	"testing"
+)
+
+// Tests that status reports the code & date of a registration, leaving out
+// dates which were never recorded
+func TestListener_status(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{})
+	uid := id.NewIdFromString("user", id.User, t)
+	legacy := id.NewIdFromString("legacy", id.User, t)
+	l.s.Register(uid, "CODE")
+	err := l.s.UseCode(&storage.User{
+		ID:     legacy.String(),
+		Code:   "CODE",
+		Status: storage.StatusApproved,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to add registration: %+v", err)
+	}
+
+	if strResponse := l.status(uid); !strings.Contains(strResponse, "CODE on ") {
+		t.Errorf("Status does not include the registration date: %q", strResponse)
+	}
+	strResponse := l.status(legacy)
+	if !strings.Contains(strResponse, "CODE.") || strings.Contains(strResponse, "0001") {
+		t.Errorf("Status of a registration without a date is %q", strResponse)
+	}
+}
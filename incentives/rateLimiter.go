@@ -0,0 +1,153 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"gitlab.com/xx_network/primitives/id"
+	"sync"
+	"time"
+)
+
+// Number of sender buckets held before idle buckets are pruned
+const maxIdleBuckets = 10000
+
+// RateLimitParams configures the token buckets used to limit incoming
+// messages.  A capacity of zero disables the corresponding limit.
+type RateLimitParams struct {
+	// Burst size & refill period for each individual sender
+	UserCapacity int
+	UserPeriod   time.Duration
+	// Burst size & refill period shared across all senders
+	GlobalCapacity int
+	GlobalPeriod   time.Duration
+}
+
+// bucket is a token bucket which gains one token every period up to capacity
+type bucket struct {
+	capacity float64
+	period   time.Duration
+	tokens   float64
+	last     time.Time
+	// End of the limited period a rate limit notice was last sent for
+	noticed time.Time
+}
+
+// newBucket returns a full bucket
+func newBucket(capacity int, period time.Duration, now time.Time) *bucket {
+	return &bucket{
+		capacity: float64(capacity),
+		period:   period,
+		tokens:   float64(capacity),
+		last:     now,
+	}
+}
+
+// refill adds the tokens accrued since the bucket was last used
+func (b *bucket) refill(now time.Time) {
+	if b.period > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.period)
+	} else {
+		b.tokens = b.capacity
+	}
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// wait returns how long until the bucket holds a token
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(b.period))
+}
+
+// notice returns whether a rate limit notice should be sent for a message
+// dropped by the bucket, allowing one notice per limited period
+func (b *bucket) notice(now time.Time, wait time.Duration) bool {
+	if now.Before(b.noticed) {
+		return false
+	}
+	b.noticed = now.Add(wait)
+	return true
+}
+
+// rateLimiter limits messages using a token bucket per sender ID as well as a
+// global bucket capping the total rate the bot will process
+type rateLimiter struct {
+	params  RateLimitParams
+	global  *bucket
+	senders map[id.ID]*bucket
+	mux     sync.Mutex
+}
+
+// newRateLimiter initializes a rateLimiter with the passed in params
+func newRateLimiter(params RateLimitParams) *rateLimiter {
+	return &rateLimiter{
+		params:  params,
+		global:  newBucket(params.GlobalCapacity, params.GlobalPeriod, time.Now()),
+		senders: make(map[id.ID]*bucket),
+	}
+}
+
+// allow consumes a token for the sender if one is available from both the
+// sender's and global buckets.  Otherwise, returns how long until it may retry
+// and whether the sender should be notified.  Only the first message dropped
+// in a limited period is notified, per sender for the sender's bucket & in
+// total for the global bucket, so floods do not cause floods of replies.
+func (rl *rateLimiter) allow(sender *id.ID) (bool, time.Duration, bool) {
+	return rl.allowAt(sender, time.Now())
+}
+
+// allowAt runs allow as of the given time
+func (rl *rateLimiter) allowAt(sender *id.ID, now time.Time) (bool, time.Duration, bool) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	var user *bucket
+	if rl.params.UserCapacity > 0 {
+		var ok bool
+		user, ok = rl.senders[*sender]
+		if !ok {
+			if len(rl.senders) >= maxIdleBuckets {
+				rl.prune(now)
+			}
+			user = newBucket(rl.params.UserCapacity, rl.params.UserPeriod, now)
+			rl.senders[*sender] = user
+		}
+		user.refill(now)
+		if wait := user.wait(); wait > 0 {
+			return false, wait, user.notice(now, wait)
+		}
+	}
+
+	if rl.params.GlobalCapacity > 0 {
+		rl.global.refill(now)
+		if wait := rl.global.wait(); wait > 0 {
+			return false, wait, rl.global.notice(now, wait)
+		}
+		rl.global.tokens--
+	}
+
+	if user != nil {
+		user.tokens--
+	}
+	return true, 0, false
+}
+
+// prune drops buckets which have refilled completely, as they are
+// indistinguishable from a new bucket
+func (rl *rateLimiter) prune(now time.Time) {
+	for sender, b := range rl.senders {
+		b.refill(now)
+		if b.tokens >= b.capacity {
+			delete(rl.senders, sender)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+	"time"
+)
+
+// Tests that a sender may send a burst of capacity messages, then one message
+// per period as their bucket refills
+func TestRateLimiter_UserBucket(t *testing.T) {
+	rl := newRateLimiter(RateLimitParams{UserCapacity: 3, UserPeriod: time.Minute})
+	sender := id.NewIdFromString("sender", id.User, t)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := rl.allowAt(sender, now); !ok {
+			t.Fatalf("Message %d of burst was limited", i)
+		}
+	}
+	ok, wait, _ := rl.allowAt(sender, now)
+	if ok {
+		t.Fatal("Message exceeding the burst was allowed")
+	} else if wait != time.Minute {
+		t.Errorf("Expected wait of %s, got %s", time.Minute, wait)
+	}
+
+	if ok, _, _ = rl.allowAt(sender, now.Add(30*time.Second)); ok {
+		t.Error("Message allowed before a token was refilled")
+	}
+	if ok, _, _ = rl.allowAt(sender, now.Add(time.Minute)); !ok {
+		t.Error("Message limited after a token was refilled")
+	}
+	if ok, _, _ = rl.allowAt(sender, now.Add(time.Minute)); ok {
+		t.Error("Refilled token was consumed twice")
+	}
+}
+
+// Tests that each sender has their own bucket
+func TestRateLimiter_SendersIndependent(t *testing.T) {
+	rl := newRateLimiter(RateLimitParams{UserCapacity: 1, UserPeriod: time.Minute})
+	a := id.NewIdFromString("a", id.User, t)
+	b := id.NewIdFromString("b", id.User, t)
+	now := time.Now()
+
+	if ok, _, _ := rl.allowAt(a, now); !ok {
+		t.Fatal("First message from a was limited")
+	}
+	if ok, _, _ := rl.allowAt(a, now); ok {
+		t.Error("Second message from a was allowed")
+	}
+	if ok, _, _ := rl.allowAt(b, now); !ok {
+		t.Error("Message from b was limited by a's bucket")
+	}
+}
+
+// Tests that the global bucket limits all senders together & that messages
+// refused by it do not consume the sender's token
+func TestRateLimiter_GlobalBucket(t *testing.T) {
+	rl := newRateLimiter(RateLimitParams{
+		UserCapacity:   1,
+		UserPeriod:     time.Hour,
+		GlobalCapacity: 2,
+		GlobalPeriod:   time.Minute,
+	})
+	now := time.Now()
+	senders := []*id.ID{
+		id.NewIdFromString("a", id.User, t),
+		id.NewIdFromString("b", id.User, t),
+		id.NewIdFromString("c", id.User, t),
+	}
+
+	for _, sender := range senders[:2] {
+		if ok, _, _ := rl.allowAt(sender, now); !ok {
+			t.Fatalf("Message from %s was limited", sender)
+		}
+	}
+	if ok, _, _ := rl.allowAt(senders[2], now); ok {
+		t.Fatal("Message exceeding the global capacity was allowed")
+	}
+	if ok, _, _ := rl.allowAt(senders[2], now.Add(time.Minute)); !ok {
+		t.Error("Sender's token was consumed by a globally limited message")
+	}
+}
+
+// Tests that a limited sender is notified once per limited period, and that
+// a drained global bucket notifies once in total rather than every sender
+func TestRateLimiter_NoticeOncePerPeriod(t *testing.T) {
+	rl := newRateLimiter(RateLimitParams{UserCapacity: 1, UserPeriod: time.Minute})
+	sender := id.NewIdFromString("sender", id.User, t)
+	now := time.Now()
+
+	rl.allowAt(sender, now)
+	if _, _, notify := rl.allowAt(sender, now); !notify {
+		t.Error("First limited message was not notified")
+	}
+	for i := 1; i <= 5; i++ {
+		if _, _, notify := rl.allowAt(sender, now.Add(time.Duration(i)*time.Second)); notify {
+			t.Errorf("Limited message %d in the same period was notified", i)
+		}
+	}
+
+	// Once the period ends the sender may send again, and a new limited
+	// period may be notified
+	later := now.Add(time.Minute)
+	if ok, _, _ := rl.allowAt(sender, later); !ok {
+		t.Fatal("Message limited after the period ended")
+	}
+	if _, _, notify := rl.allowAt(sender, later); !notify {
+		t.Error("Limited message in a new period was not notified")
+	}
+
+	rl = newRateLimiter(RateLimitParams{GlobalCapacity: 1, GlobalPeriod: time.Minute})
+	now = time.Now()
+	rl.allowAt(sender, now)
+	notices := 0
+	for i := 0; i < 10; i++ {
+		other := id.NewIdFromUInt(uint64(i), id.User, t)
+		if ok, _, notify := rl.allowAt(other, now); ok {
+			t.Fatalf("Message from sender %d exceeding the global capacity was allowed", i)
+		} else if notify {
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Errorf("Expected 1 notice while the global bucket was drained, got %d", notices)
+	}
+}
+
+// Tests that pruning only drops buckets which have fully refilled
+func TestRateLimiter_Prune(t *testing.T) {
+	rl := newRateLimiter(RateLimitParams{UserCapacity: 2, UserPeriod: time.Minute})
+	a := id.NewIdFromString("a", id.User, t)
+	b := id.NewIdFromString("b", id.User, t)
+	now := time.Now()
+
+	rl.allowAt(a, now)
+	rl.allowAt(b, now.Add(time.Minute))
+	rl.prune(now.Add(90 * time.Second))
+
+	if _, ok := rl.senders[*a]; ok {
+		t.Error("Refilled bucket was not pruned")
+	}
+	if _, ok := rl.senders[*b]; !ok {
+		t.Error("Partially refilled bucket was pruned")
+	}
+}
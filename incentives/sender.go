@@ -0,0 +1,242 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"bytes"
+	"encoding/json"
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/client/api"
+	"gitlab.com/elixxir/client/interfaces/message"
+	"gitlab.com/elixxir/client/interfaces/params"
+	"gitlab.com/xx_network/primitives/id"
+	"net/http"
+	"time"
+)
+
+// Number of queued messages delivered per poll of storage
+const sendBatchSize = 100
+
+// Timeout for posting alerts to the webhook
+const webhookTimeout = 10 * time.Second
+
+// sender delivers the messages queued in storage by the rest of the bot
+type sender struct {
+	s        *storage.Storage
+	c        *api.Client
+	admins   []*id.ID
+	webhook  string
+	interval time.Duration
+	// How often notices held for digests are combined & queued
+	digestInterval time.Duration
+	// Number of broadcast messages sent every broadcastInterval
+	broadcastBatchSize int
+	broadcastInterval  time.Duration
+	http               *http.Client
+}
+
+// run polls storage for queued messages & delivers them until stop is closed
+func (snd *sender) run(stop chan struct{}) {
+	ticker := time.NewTicker(snd.interval)
+	defer ticker.Stop()
+	digestTicker := time.NewTicker(snd.digestInterval)
+	defer digestTicker.Stop()
+	broadcastTicker := time.NewTicker(snd.broadcastInterval)
+	defer broadcastTicker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			snd.deliverQueued()
+		case <-digestTicker.C:
+			err := snd.s.FlushDigests()
+			if err != nil {
+				jww.ERROR.Printf("Failed to flush digests: %+v", err)
+			}
+		case <-broadcastTicker.C:
+			snd.deliverBroadcasts()
+		}
+	}
+}
+
+// deliverQueued sends a batch of queued messages and records the outcome
+func (snd *sender) deliverQueued() {
+	messages, err := snd.s.GetQueuedMessages(sendBatchSize)
+	if err != nil {
+		jww.ERROR.Printf("Failed to get queued messages: %+v", err)
+		return
+	}
+
+	for _, m := range messages {
+		var err error
+		status := storage.MessageSent
+		switch {
+		case m.Kind == storage.MessageAlert:
+			err = snd.deliverAlert(m.Text)
+		case snd.s.OptedOut(m.Recipient):
+			// The recipient may have opted out since the message was queued
+			status = storage.MessageSkipped
+		default:
+			err = snd.deliver(m)
+		}
+
+		if err != nil {
+			jww.ERROR.Printf("Failed to deliver message %d: %+v", m.ID, err)
+			status = storage.MessageFailed
+		}
+		err = snd.s.UpdateMessageStatus(m.ID, status)
+		if err != nil {
+			jww.ERROR.Printf("Failed to update status of message %d: %+v", m.ID, err)
+		}
+	}
+}
+
+// deliverBroadcasts sends the next batch of broadcast messages, skipping
+// recipients who are blocked or opted out, then finishes the broadcasts with
+// nothing left queued
+func (snd *sender) deliverBroadcasts() {
+	deliveries, err := snd.s.GetQueuedDeliveries(snd.broadcastBatchSize)
+	if err != nil {
+		jww.ERROR.Printf("Failed to get queued broadcast deliveries: %+v", err)
+		return
+	}
+
+	broadcasts := map[uint64]*storage.Broadcast{}
+	for _, d := range deliveries {
+		b, ok := broadcasts[d.BroadcastID]
+		if !ok {
+			b, err = snd.s.GetBroadcast(d.BroadcastID)
+			if err != nil {
+				jww.ERROR.Printf("Failed to get broadcast %d: %+v", d.BroadcastID, err)
+				continue
+			}
+			broadcasts[d.BroadcastID] = b
+		}
+
+		// Deliveries are left queued until the blocklist can be checked
+		blocked, err := snd.s.CheckBlockedUser(d.UserID)
+		if err != nil {
+			jww.ERROR.Printf("Failed to check blocklist for %s: %+v", d.UserID, err)
+			continue
+		}
+
+		status := storage.MessageSent
+		if blocked || snd.s.OptedOut(d.UserID) {
+			status = storage.MessageSkipped
+		} else {
+			err = snd.deliver(&storage.Message{Recipient: d.UserID, Text: b.Text})
+			if err != nil {
+				jww.ERROR.Printf("Failed to deliver broadcast %d to %s: %+v", b.ID, d.UserID, err)
+				status = storage.MessageFailed
+			}
+		}
+		err = snd.s.UpdateDeliveryStatus(d.BroadcastID, d.UserID, status)
+		if err != nil {
+			jww.ERROR.Printf("Failed to record delivery of broadcast %d to %s: %+v",
+				b.ID, d.UserID, err)
+		}
+	}
+
+	for id := range broadcasts {
+		err = snd.s.FinishBroadcast(id)
+		if err != nil {
+			jww.ERROR.Printf("Failed to finish broadcast %d: %+v", id, err)
+		}
+	}
+}
+
+// deliver sends a queued message to its recipient
+func (snd *sender) deliver(m *storage.Message) error {
+	recipient, err := storage.ParseUserID(m.Recipient)
+	if err != nil {
+		return errors.WithMessagef(err, "Invalid recipient %s", m.Recipient)
+	}
+	return sendText(snd.c, recipient, m.Text, nil)
+}
+
+// deliverAlert sends an alert to every admin & the webhook, succeeding if
+// any of them received it
+func (snd *sender) deliverAlert(text string) error {
+	var delivered bool
+	for _, admin := range snd.admins {
+		err := sendText(snd.c, admin, text, nil)
+		if err != nil {
+			jww.ERROR.Printf("Failed to send alert to admin %s: %+v", admin, err)
+			continue
+		}
+		delivered = true
+	}
+
+	if snd.webhook != "" {
+		err := snd.postWebhook(text)
+		if err != nil {
+			jww.ERROR.Printf("Failed to post alert to webhook: %+v", err)
+		} else {
+			delivered = true
+		}
+	}
+
+	if !delivered {
+		return errors.New("No admin or webhook received the alert")
+	}
+	return nil
+}
+
+// postWebhook posts the text to the configured webhook as JSON
+func (snd *sender) postWebhook(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	resp, err := snd.http.Post(snd.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("Webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// sendText sends a text message to the recipient over an existing
+// authenticated channel, optionally as a reply to a received message
+func sendText(c *api.Client, recipient *id.ID, text string, reply *TextReply) error {
+	if !c.HasAuthenticatedChannel(recipient) {
+		return errors.Errorf("No authenticated channel exists to %s", recipient)
+	}
+
+	payload := &CMIXText{
+		Version: 0,
+		Text:    text,
+		Reply:   reply,
+	}
+	marshalled, err := proto.Marshal(payload)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to marshal payload")
+	}
+
+	// Create message
+	msg := message.Send{
+		Recipient:   recipient,
+		Payload:     marshalled,
+		MessageType: message.XxMessage,
+	}
+
+	// Send message to recipient over cmix
+	rids, mid, t, err := c.SendE2E(msg, params.GetDefaultE2E())
+	if err != nil {
+		return errors.WithMessage(err, "Failed to send message")
+	}
+	jww.INFO.Printf("Sent %s [%+v] to %+v on rounds %+v [%+v]", text, mid, recipient, rids, t)
+	return nil
+}
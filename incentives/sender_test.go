@@ -0,0 +1,80 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package incentives
+
+import (
+	"git.xx.network/elixxir/incentives-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+)
+
+// Tests that broadcasts skip users who are blocked or opted out, & finish
+// once every delivery is recorded
+func TestSender_deliverBroadcasts_Skipped(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{})
+	blocked := id.NewIdFromString("blocked", id.User, t)
+	optedOut := id.NewIdFromString("optedOut", id.User, t)
+	l.s.Register(blocked, "CODE")
+	l.s.Register(optedOut, "CODE")
+	err := l.s.BlockUser(blocked.String(), "spam")
+	if err != nil {
+		t.Fatalf("Failed to block user: %+v", err)
+	}
+	l.setNotifications(optedOut, "off")
+
+	b, err := l.s.CreateBroadcast("hello", storage.Segment{})
+	if err != nil {
+		t.Fatalf("Failed to create broadcast: %+v", err)
+	}
+	snd := &sender{s: l.s, broadcastBatchSize: 10}
+	snd.deliverBroadcasts()
+
+	counts, err := l.s.CountDeliveries(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to count deliveries: %+v", err)
+	}
+	if counts[storage.MessageSkipped] != 2 || counts[storage.MessageSent] != 0 {
+		t.Errorf("Expected both deliveries skipped, got %v", counts)
+	}
+	b, err = l.s.GetBroadcast(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to get broadcast: %+v", err)
+	}
+	if b.State != storage.BroadcastDone {
+		t.Errorf("Broadcast is %s, expected %s", b.State, storage.BroadcastDone)
+	}
+}
+
+// Tests that messages queued to users who then sent stop are skipped, & that
+// start lets messages through again
+func TestSender_deliverQueued_OptedOut(t *testing.T) {
+	owner := id.NewIdFromString("owner", id.User, t)
+	l := newTestListener(t, owner, storage.Config{})
+	l.s.Register(id.NewIdFromString("user", id.User, t), "CODE")
+	queued, err := l.s.GetMessagesByStatus(storage.MessageQueued)
+	if err != nil || len(queued) != 1 || queued[0].Recipient != owner.String() {
+		t.Fatalf("Expected a notice queued to the owner: %+v, %v", queued, err)
+	}
+
+	l.router.route(l, owner, "stop")
+	snd := &sender{s: l.s}
+	snd.deliverQueued()
+	skipped, err := l.s.GetMessagesByStatus(storage.MessageSkipped)
+	if err != nil {
+		t.Fatalf("Failed to get messages: %+v", err)
+	}
+	if len(skipped) != 1 || skipped[0].ID != queued[0].ID {
+		t.Errorf("Expected the notice to be skipped, got %+v", skipped)
+	}
+
+	l.router.route(l, owner, "start")
+	if l.s.OptedOut(owner.String()) {
+		t.Error("Owner is still opted out after start")
+	}
+}
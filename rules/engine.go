@@ -0,0 +1,109 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package rules
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Engine evaluates registrations against a rule set loaded from a file,
+// reloading it when the file changes
+type Engine struct {
+	path    string
+	rules   *RuleSet
+	modTime time.Time
+	mux     sync.RWMutex
+}
+
+// NewEngine returns an engine evaluating the default rules if path is empty,
+// or the rules loaded from the file at path otherwise
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path, rules: Default()}
+	if path == "" {
+		return e, nil
+	}
+	_, err := e.reload()
+	return e, err
+}
+
+// NewStaticEngine returns an engine evaluating the rule set, which is not
+// loaded from a file & so never reloaded
+func NewStaticEngine(rs *RuleSet) (*Engine, error) {
+	return &Engine{rules: rs}, rs.Validate()
+}
+
+// Load reads & validates the rule set in the file at path
+func Load(path string) (*RuleSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "Failed to read rules file %s", path)
+	}
+	return Parse(data)
+}
+
+// Evaluate applies the current rules to the registration
+func (e *Engine) Evaluate(r Registration) Outcome {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.rules.Evaluate(r)
+}
+
+// Watch checks the rules file for changes every interval & reloads it until
+// stop is closed.  Invalid changes are logged & the previous rules kept.
+func (e *Engine) Watch(interval time.Duration, stop chan struct{}) {
+	if e.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := e.reload()
+			if err != nil {
+				jww.ERROR.Printf("Failed to reload rules, keeping previous rules: %+v", err)
+			} else if reloaded {
+				jww.INFO.Printf("Reloaded rules from %s", e.path)
+			}
+		}
+	}
+}
+
+// reload loads the rules file if it was modified since it was last loaded.
+// Returns whether the rules were replaced.
+func (e *Engine) reload() (bool, error) {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, errors.WithMessagef(err, "Failed to stat rules file %s", e.path)
+	}
+
+	e.mux.RLock()
+	unchanged := info.ModTime().Equal(e.modTime)
+	e.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	rs, err := Load(e.path)
+	if err != nil {
+		return false, err
+	}
+
+	e.mux.Lock()
+	e.rules = rs
+	e.modTime = info.ModTime()
+	e.mux.Unlock()
+	return true, nil
+}
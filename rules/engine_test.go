@@ -0,0 +1,79 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRules writes the rules file with the given modification time
+func writeRules(t *testing.T, path, data string, modTime time.Time) {
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write rules: %+v", err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatalf("Failed to set modification time: %+v", err)
+	}
+}
+
+// Tests that the engine reloads changed rules & keeps the previous rules if
+// the changed file is invalid
+func TestEngine_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	now := time.Now()
+	writeRules(t, path, "rules:\n  - name: a\n    then:\n      - type: credit\n        amount: 1\n", now)
+
+	e, err := NewEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %+v", err)
+	}
+	if total := e.Evaluate(Registration{}).Total(ToReferrer); total != 1 {
+		t.Fatalf("Expected credit of 1 from loaded rules, got %d", total)
+	}
+
+	reloaded, err := e.reload()
+	if err != nil || reloaded {
+		t.Errorf("Unchanged rules were reloaded: %t, %v", reloaded, err)
+	}
+
+	writeRules(t, path, "rules:\n  - name: b\n    then:\n      - type: credit\n        amount: 2\n",
+		now.Add(time.Second))
+	reloaded, err = e.reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Changed rules were not reloaded: %t, %v", reloaded, err)
+	}
+	if total := e.Evaluate(Registration{}).Total(ToReferrer); total != 2 {
+		t.Errorf("Expected credit of 2 from reloaded rules, got %d", total)
+	}
+
+	writeRules(t, path, "rules:\n  - name: c\n    then:\n      - type: bonus\n",
+		now.Add(2*time.Second))
+	if _, err = e.reload(); err == nil {
+		t.Error("Expected an error reloading invalid rules")
+	}
+	if total := e.Evaluate(Registration{}).Total(ToReferrer); total != 2 {
+		t.Errorf("Expected previous credit of 2 after invalid rules, got %d", total)
+	}
+}
+
+// Tests that an engine without a rules file evaluates the default rules
+func TestNewEngine_Default(t *testing.T) {
+	e, err := NewEngine("")
+	if err != nil {
+		t.Fatalf("Failed to create engine: %+v", err)
+	}
+	if total := e.Evaluate(Registration{}).Total(ToReferrer); total != 10 {
+		t.Errorf("Expected default credit of 10, got %d", total)
+	}
+}
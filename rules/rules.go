@@ -0,0 +1,302 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package rules evaluates registrations against a declarative set of rules to
+// determine the rewards credited for them & whether they are held or rejected
+
+package rules
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"strings"
+	"time"
+)
+
+// Action types
+const (
+	// Credit a reward to the referrer, referee or a code up the referral chain
+	ActionCredit = "credit"
+	// Credit a bonus to the code once it reaches a number of uses
+	ActionMilestone = "milestone"
+	// Hold the registration for review
+	ActionHold = "hold"
+	// Refuse the registration
+	ActionReject = "reject"
+)
+
+// Recipients of credit actions
+const (
+	// The code used to register
+	ToReferrer = "referrer"
+	// The registering user
+	ToReferee = "referee"
+	// The code Tier steps up the referral chain from the code used
+	ToUpline = "upline"
+)
+
+// Layout of dates in rules files
+const dateLayout = "2006-01-02"
+
+// Registration describes a registration being evaluated
+type Registration struct {
+	Code     string
+	Campaign string
+	Tags     []string
+	// Approved uses of the code, including this registration
+	Uses int
+	Time time.Time
+}
+
+// Conditions which must all hold for a rule to fire.  Unset conditions always
+// hold.
+type Conditions struct {
+	// Campaign of the code is one of these
+	Campaigns []string `yaml:"campaigns"`
+	// Code has at least one of these tags
+	Tags []string `yaml:"tags"`
+	// Approved uses of the code, including this registration, are within range
+	MinUses int `yaml:"minUses"`
+	MaxUses int `yaml:"maxUses"`
+	// Registration is made on or after After & before Before
+	After  Date `yaml:"after"`
+	Before Date `yaml:"before"`
+}
+
+// Action applied when a rule fires
+type Action struct {
+	Type string `yaml:"type"`
+	// Recipient of a credit; defaults to the referrer
+	To string `yaml:"to"`
+	// Steps up the referral chain for credits to the upline
+	Tier int `yaml:"tier"`
+	// Reward credited, or the bonus of a milestone
+	Amount int `yaml:"amount"`
+	// Uses at which a milestone bonus is credited
+	Uses int `yaml:"uses"`
+	// Explanation sent to the user for holds & rejections
+	Message string `yaml:"message"`
+}
+
+// Rule applies its actions to registrations meeting its conditions
+type Rule struct {
+	Name string     `yaml:"name"`
+	When Conditions `yaml:"when"`
+	Then []Action   `yaml:"then"`
+	// Skip the remaining rules if this one fires
+	Final bool `yaml:"final"`
+}
+
+// RuleSet is an ordered list of rules
+type RuleSet struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Credit is a reward to be credited for a registration
+type Credit struct {
+	Rule   string
+	To     string
+	Tier   int
+	Amount int
+}
+
+// Milestone is a bonus credited to a code once it reaches a number of uses
+type Milestone struct {
+	Rule  string
+	Uses  int
+	Bonus int
+}
+
+// Outcome is the combined result of the rules fired for a registration
+type Outcome struct {
+	// Names of the rules which fired, in order
+	Fired      []string
+	Credits    []Credit
+	Milestones []Milestone
+	Hold       bool
+	Reject     bool
+	// Explanation from the hold or reject action which applied
+	Message string
+}
+
+// Default returns the rule set used when no rules file is configured, which
+// credits each code 10 per registration
+func Default() *RuleSet {
+	return &RuleSet{Rules: []Rule{{
+		Name: "default referral reward",
+		Then: []Action{{Type: ActionCredit, To: ToReferrer, Amount: 10}},
+	}}}
+}
+
+// Parse decodes & validates a YAML rule set
+func Parse(data []byte) (*RuleSet, error) {
+	rs := &RuleSet{}
+	err := yaml.UnmarshalStrict(data, rs)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to parse rules")
+	}
+	return rs, rs.Validate()
+}
+
+// Validate checks that every action in the rule set is well formed
+func (rs *RuleSet) Validate() error {
+	for i, rule := range rs.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		for _, a := range rule.Then {
+			switch a.Type {
+			case ActionCredit:
+				switch a.To {
+				case "", ToReferrer, ToReferee:
+				case ToUpline:
+					if a.Tier < 1 {
+						return errors.Errorf("rule %s: upline credits need a tier of at least 1", name)
+					}
+				default:
+					return errors.Errorf("rule %s: unknown credit recipient %q", name, a.To)
+				}
+			case ActionMilestone:
+				if a.Uses < 1 {
+					return errors.Errorf("rule %s: milestones need uses of at least 1", name)
+				}
+			case ActionHold, ActionReject:
+			default:
+				return errors.Errorf("rule %s: unknown action type %q", name, a.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate applies the rules to the registration in order, combining the
+// actions of every rule which fires.  A rejection overrides any credits.
+func (rs *RuleSet) Evaluate(r Registration) Outcome {
+	var o Outcome
+	for _, rule := range rs.Rules {
+		if !rule.When.match(r) {
+			continue
+		}
+		o.Fired = append(o.Fired, rule.Name)
+		for _, a := range rule.Then {
+			switch a.Type {
+			case ActionCredit:
+				to := a.To
+				if to == "" {
+					to = ToReferrer
+				}
+				o.Credits = append(o.Credits, Credit{
+					Rule:   rule.Name,
+					To:     to,
+					Tier:   a.Tier,
+					Amount: a.Amount,
+				})
+			case ActionMilestone:
+				if r.Uses >= a.Uses {
+					o.Milestones = append(o.Milestones, Milestone{
+						Rule:  rule.Name,
+						Uses:  a.Uses,
+						Bonus: a.Amount,
+					})
+				}
+			case ActionHold:
+				o.Hold = true
+				if !o.Reject && a.Message != "" {
+					o.Message = a.Message
+				}
+			case ActionReject:
+				o.Reject = true
+				o.Message = a.Message
+			}
+		}
+		if rule.Final {
+			break
+		}
+	}
+
+	if o.Reject {
+		o.Credits = nil
+		o.Milestones = nil
+	}
+	return o
+}
+
+// Total returns the sum of the credits to the recipient
+func (o Outcome) Total(to string) int {
+	total := 0
+	for _, c := range o.Credits {
+		if c.To == to {
+			total += c.Amount
+		}
+	}
+	return total
+}
+
+// match returns whether the registration meets all the conditions
+func (c Conditions) match(r Registration) bool {
+	if len(c.Campaigns) > 0 && !containsFold(c.Campaigns, r.Campaign) {
+		return false
+	}
+	if len(c.Tags) > 0 {
+		tagged := false
+		for _, tag := range r.Tags {
+			if containsFold(c.Tags, tag) {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+	if c.MinUses > 0 && r.Uses < c.MinUses {
+		return false
+	}
+	if c.MaxUses > 0 && r.Uses > c.MaxUses {
+		return false
+	}
+	if !c.After.IsZero() && r.Time.Before(c.After.Time) {
+		return false
+	}
+	if !c.Before.IsZero() && !r.Time.Before(c.Before.Time) {
+		return false
+	}
+	return true
+}
+
+// containsFold returns whether the list contains the string, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Date is a UTC date written as YYYY-MM-DD in rules files
+type Date struct {
+	time.Time
+}
+
+// UnmarshalYAML parses a date in the YYYY-MM-DD layout
+func (d *Date) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	err := unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+	d.Time, err = time.Parse(dateLayout, raw)
+	return err
+}
+
+// ParseDate parses a date in the YYYY-MM-DD layout used by rules files
+func ParseDate(raw string) (time.Time, error) {
+	return time.Parse(dateLayout, raw)
+}
@@ -0,0 +1,315 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package rules
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// date returns the date in the rules file layout, failing the test if invalid
+func date(t *testing.T, raw string) Date {
+	d, err := ParseDate(raw)
+	if err != nil {
+		t.Fatalf("Invalid date %s: %+v", raw, err)
+	}
+	return Date{d}
+}
+
+// Tests that each condition only matches the registrations it describes
+func TestConditions_match(t *testing.T) {
+	reg := Registration{
+		Code:     "ABC",
+		Campaign: "Launch",
+		Tags:     []string{"partner", "eu"},
+		Uses:     5,
+		Time:     time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name  string
+		when  Conditions
+		match bool
+	}{
+		{"none", Conditions{}, true},
+		{"campaign", Conditions{Campaigns: []string{"other", "launch"}}, true},
+		{"other campaign", Conditions{Campaigns: []string{"other"}}, false},
+		{"tag", Conditions{Tags: []string{"EU"}}, true},
+		{"other tag", Conditions{Tags: []string{"us"}}, false},
+		{"min uses", Conditions{MinUses: 5}, true},
+		{"below min uses", Conditions{MinUses: 6}, false},
+		{"max uses", Conditions{MaxUses: 5}, true},
+		{"above max uses", Conditions{MaxUses: 4}, false},
+		{"after", Conditions{After: date(t, "2022-06-15")}, true},
+		{"before after", Conditions{After: date(t, "2022-06-16")}, false},
+		{"before", Conditions{Before: date(t, "2022-06-16")}, true},
+		{"on before", Conditions{Before: date(t, "2022-06-15")}, false},
+		{"all", Conditions{
+			Campaigns: []string{"launch"},
+			Tags:      []string{"partner"},
+			MinUses:   1,
+			MaxUses:   10,
+			After:     date(t, "2022-01-01"),
+			Before:    date(t, "2023-01-01"),
+		}, true},
+		{"all but one", Conditions{
+			Campaigns: []string{"launch"},
+			Tags:      []string{"partner"},
+			MinUses:   1,
+			MaxUses:   10,
+			After:     date(t, "2022-01-01"),
+			Before:    date(t, "2022-02-01"),
+		}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.when.match(reg); got != tt.match {
+			t.Errorf("%s: match returned %t, expected %t", tt.name, got, tt.match)
+		}
+	}
+}
+
+// Tests combining the actions of the rules which fire
+func TestRuleSet_Evaluate(t *testing.T) {
+	reg := Registration{Code: "ABC", Campaign: "launch", Tags: []string{"partner"}, Uses: 3}
+	tests := []struct {
+		name    string
+		rules   []Rule
+		outcome Outcome
+	}{
+		{
+			name:  "default",
+			rules: Default().Rules,
+			outcome: Outcome{
+				Fired:   []string{"default referral reward"},
+				Credits: []Credit{{Rule: "default referral reward", To: ToReferrer, Amount: 10}},
+			},
+		},
+		{
+			name: "credits combine",
+			rules: []Rule{
+				{Name: "base", Then: []Action{
+					{Type: ActionCredit, Amount: 10},
+					{Type: ActionCredit, To: ToReferee, Amount: 5},
+				}},
+				{Name: "partner", When: Conditions{Tags: []string{"partner"}}, Then: []Action{
+					{Type: ActionCredit, To: ToUpline, Tier: 1, Amount: 2},
+				}},
+				{Name: "other", When: Conditions{Campaigns: []string{"other"}}, Then: []Action{
+					{Type: ActionCredit, Amount: 100},
+				}},
+			},
+			outcome: Outcome{
+				Fired: []string{"base", "partner"},
+				Credits: []Credit{
+					{Rule: "base", To: ToReferrer, Amount: 10},
+					{Rule: "base", To: ToReferee, Amount: 5},
+					{Rule: "partner", To: ToUpline, Tier: 1, Amount: 2},
+				},
+			},
+		},
+		{
+			name: "final",
+			rules: []Rule{
+				{Name: "promo", Final: true, Then: []Action{{Type: ActionCredit, Amount: 20}}},
+				{Name: "base", Then: []Action{{Type: ActionCredit, Amount: 10}}},
+			},
+			outcome: Outcome{
+				Fired:   []string{"promo"},
+				Credits: []Credit{{Rule: "promo", To: ToReferrer, Amount: 20}},
+			},
+		},
+		{
+			name: "final not fired",
+			rules: []Rule{
+				{Name: "promo", Final: true, When: Conditions{MinUses: 10},
+					Then: []Action{{Type: ActionCredit, Amount: 20}}},
+				{Name: "base", Then: []Action{{Type: ActionCredit, Amount: 10}}},
+			},
+			outcome: Outcome{
+				Fired:   []string{"base"},
+				Credits: []Credit{{Rule: "base", To: ToReferrer, Amount: 10}},
+			},
+		},
+		{
+			name: "reject overrides credits",
+			rules: []Rule{
+				{Name: "base", Then: []Action{
+					{Type: ActionCredit, Amount: 10},
+					{Type: ActionMilestone, Uses: 1, Amount: 50},
+				}},
+				{Name: "closed", Then: []Action{{Type: ActionReject, Message: "campaign closed"}}},
+			},
+			outcome: Outcome{
+				Fired:   []string{"base", "closed"},
+				Reject:  true,
+				Message: "campaign closed",
+			},
+		},
+		{
+			name: "hold keeps credits",
+			rules: []Rule{
+				{Name: "base", Then: []Action{{Type: ActionCredit, Amount: 10}}},
+				{Name: "review", Then: []Action{{Type: ActionHold, Message: "under review"}}},
+			},
+			outcome: Outcome{
+				Fired:   []string{"base", "review"},
+				Credits: []Credit{{Rule: "base", To: ToReferrer, Amount: 10}},
+				Hold:    true,
+				Message: "under review",
+			},
+		},
+		{
+			name: "reject message beats hold message",
+			rules: []Rule{
+				{Name: "closed", Then: []Action{{Type: ActionReject, Message: "campaign closed"}}},
+				{Name: "review", Then: []Action{{Type: ActionHold, Message: "under review"}}},
+			},
+			outcome: Outcome{
+				Fired:   []string{"closed", "review"},
+				Hold:    true,
+				Reject:  true,
+				Message: "campaign closed",
+			},
+		},
+	}
+	for _, tt := range tests {
+		rs := &RuleSet{Rules: tt.rules}
+		if got := rs.Evaluate(reg); !reflect.DeepEqual(got, tt.outcome) {
+			t.Errorf("%s: expected outcome %+v, got %+v", tt.name, tt.outcome, got)
+		}
+	}
+}
+
+// Tests that milestones are reached once the code's uses meet their threshold
+func TestRuleSet_Evaluate_Milestones(t *testing.T) {
+	rs := &RuleSet{Rules: []Rule{{Name: "milestones", Then: []Action{
+		{Type: ActionMilestone, Uses: 10, Amount: 50},
+		{Type: ActionMilestone, Uses: 100, Amount: 500},
+	}}}}
+	tests := []struct {
+		uses  int
+		reach []int
+	}{
+		{1, nil},
+		{9, nil},
+		{10, []int{10}},
+		{99, []int{10}},
+		{100, []int{10, 100}},
+		{150, []int{10, 100}},
+	}
+	for _, tt := range tests {
+		o := rs.Evaluate(Registration{Uses: tt.uses})
+		var reached []int
+		for _, m := range o.Milestones {
+			reached = append(reached, m.Uses)
+		}
+		if !reflect.DeepEqual(reached, tt.reach) {
+			t.Errorf("%d uses: expected milestones %v, got %v", tt.uses, tt.reach, reached)
+		}
+	}
+}
+
+// Tests that Total only sums the credits to the recipient
+func TestOutcome_Total(t *testing.T) {
+	o := Outcome{Credits: []Credit{
+		{To: ToReferrer, Amount: 10},
+		{To: ToReferee, Amount: 5},
+		{To: ToReferee, Amount: 2},
+		{To: ToUpline, Tier: 1, Amount: 3},
+	}}
+	if total := o.Total(ToReferee); total != 7 {
+		t.Errorf("Expected referee total of 7, got %d", total)
+	}
+	if total := o.Total(ToReferrer); total != 10 {
+		t.Errorf("Expected referrer total of 10, got %d", total)
+	}
+}
+
+// Tests that malformed actions are refused, naming the rule
+func TestRuleSet_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		action Action
+		err    string
+	}{
+		{"credit", Action{Type: ActionCredit, Amount: 10}, ""},
+		{"referee credit", Action{Type: ActionCredit, To: ToReferee, Amount: 5}, ""},
+		{"upline credit", Action{Type: ActionCredit, To: ToUpline, Tier: 2, Amount: 1}, ""},
+		{"hold", Action{Type: ActionHold}, ""},
+		{"reject", Action{Type: ActionReject}, ""},
+		{"milestone", Action{Type: ActionMilestone, Uses: 10, Amount: 50}, ""},
+		{"upline without tier", Action{Type: ActionCredit, To: ToUpline, Amount: 1},
+			"rule upline without tier: upline credits need a tier of at least 1"},
+		{"unknown recipient", Action{Type: ActionCredit, To: "owner", Amount: 1},
+			`rule unknown recipient: unknown credit recipient "owner"`},
+		{"milestone without uses", Action{Type: ActionMilestone, Amount: 50},
+			"rule milestone without uses: milestones need uses of at least 1"},
+		{"unknown type", Action{Type: "bonus"},
+			`rule unknown type: unknown action type "bonus"`},
+	}
+	for _, tt := range tests {
+		rs := &RuleSet{Rules: []Rule{{Name: tt.name, Then: []Action{tt.action}}}}
+		err := rs.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	// Unnamed rules are identified by their position
+	rs := &RuleSet{Rules: []Rule{{}, {Then: []Action{{Type: "bonus"}}}}}
+	err := rs.Validate()
+	if err == nil || !strings.HasPrefix(err.Error(), "rule #2:") {
+		t.Errorf("Expected error naming rule #2, got %v", err)
+	}
+}
+
+// Tests parsing rules files, including dates & strict field checking
+func TestParse(t *testing.T) {
+	rs, err := Parse([]byte(`
+rules:
+  - name: launch
+    when:
+      campaigns: [launch]
+      after: 2022-06-01
+      before: 2022-07-01
+    then:
+      - type: credit
+        amount: 20
+    final: true
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %+v", err)
+	}
+	expected := &RuleSet{Rules: []Rule{{
+		Name: "launch",
+		When: Conditions{
+			Campaigns: []string{"launch"},
+			After:     date(t, "2022-06-01"),
+			Before:    date(t, "2022-07-01"),
+		},
+		Then:  []Action{{Type: ActionCredit, Amount: 20}},
+		Final: true,
+	}}}
+	if !reflect.DeepEqual(rs, expected) {
+		t.Errorf("Expected rules %+v, got %+v", expected, rs)
+	}
+
+	invalid := map[string]string{
+		"unknown field": "rules:\n  - name: x\n    then:\n      - type: credit\n        amout: 10\n",
+		"invalid date":  "rules:\n  - name: x\n    when:\n      after: June\n",
+		"invalid rule":  "rules:\n  - name: x\n    then:\n      - type: bonus\n",
+	}
+	for name, data := range invalid {
+		if _, err = Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error parsing rules", name)
+		}
+	}
+}
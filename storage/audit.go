@@ -0,0 +1,30 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the audit log of actions taken by admins over cMix
+
+package storage
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// RecordAdminAction adds a command run by an admin & the bot's response to
+// the audit log.  Failures are logged, as the command has already run.
+func (s *Storage) RecordAdminAction(adminID, command, response string) {
+	jww.INFO.Printf("Admin %s ran %q: %s", adminID, command, response)
+	err := s.InsertAdminAction(&AdminAction{
+		AdminID:   adminID,
+		Command:   command,
+		Response:  response,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to record action %q by admin %s: %+v", command, adminID, err)
+	}
+}
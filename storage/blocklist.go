@@ -0,0 +1,64 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the blocklists of users & codes barred from the incentives program
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"time"
+)
+
+// BlockUser bars a user from registering or contacting the bot
+func (s *Storage) BlockUser(uid, reason string) error {
+	return s.UpsertBlockedUser(&BlockedUser{
+		ID:        uid,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+}
+
+// UnblockUser removes a user from the blocklist
+func (s *Storage) UnblockUser(uid string) error {
+	return s.DeleteBlockedUser(uid)
+}
+
+// BlockCode bars a code from being used to register
+func (s *Storage) BlockCode(code, reason string) error {
+	return s.UpsertBlockedCode(&BlockedCode{
+		Code:      code,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+}
+
+// UnblockCode removes a code from the blocklist
+func (s *Storage) UnblockCode(code string) error {
+	return s.DeleteBlockedCode(code)
+}
+
+// IsUserBlocked returns whether the user is on the blocklist.  Callers must
+// refuse the user if the blocklist cannot be checked.
+func (s *Storage) IsUserBlocked(uid *id.ID) (bool, error) {
+	blocked, err := s.CheckBlockedUser(uid.String())
+	if err != nil {
+		return false, errors.WithMessagef(err, "Failed to check blocklist for user %s", uid)
+	}
+	return blocked, nil
+}
+
+// isCodeBlocked returns whether the code is on the blocklist.  Callers must
+// refuse the code if the blocklist cannot be checked.
+func (s *Storage) isCodeBlocked(code string) (bool, error) {
+	blocked, err := s.CheckBlockedCode(code)
+	if err != nil {
+		return false, errors.WithMessagef(err, "Failed to check blocklist for code %s", code)
+	}
+	return blocked, nil
+}
@@ -0,0 +1,102 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// blocklistErrorDB is a map backend whose blocklist cannot be checked
+type blocklistErrorDB struct {
+	*MapImpl
+}
+
+func (db *blocklistErrorDB) CheckBlockedUser(string) (bool, error) {
+	return false, errors.New("blocklist unavailable")
+}
+
+func (db *blocklistErrorDB) CheckBlockedCode(string) (bool, error) {
+	return false, errors.New("blocklist unavailable")
+}
+
+// Tests that registering with a blocked code is refused without revealing the
+// block, & recorded as a blocked attempt
+func TestStorage_Register_BlockedCode(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	createTestCode(t, s, "CODE")
+	err := s.BlockCode("CODE", "leaked")
+	if err != nil {
+		t.Fatalf("Failed to block code: %+v", err)
+	}
+	uid := id.NewIdFromString("user", id.User, t)
+
+	strResponse := s.Register(uid, "CODE")
+	expected := "Could not use code CODE"
+	if strResponse != expected {
+		t.Errorf("Expected response %q, got %q", expected, strResponse)
+	}
+	if _, err = s.GetUser(uid.String()); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("User registered with a blocked code: %v", err)
+	}
+	checkCode(t, s, "CODE", 0, 0)
+	db := s.database.(*MapImpl)
+	if len(db.attempts) != 1 || db.attempts[0].UserID != uid.String() ||
+		db.attempts[0].Result != AttemptBlocked {
+		t.Errorf("Expected one blocked attempt by the user, got %+v", db.attempts)
+	}
+
+	// Codes may be used again once unblocked
+	err = s.UnblockCode("CODE")
+	if err != nil {
+		t.Fatalf("Failed to unblock code: %+v", err)
+	}
+	registerTestUser(t, s, "user", "CODE")
+}
+
+// Tests that users & codes are refused if the blocklist cannot be checked
+func TestStorage_Blocklist_Error(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	createTestCode(t, s, "CODE")
+	s.database = &blocklistErrorDB{s.database.(*MapImpl)}
+	uid := id.NewIdFromString("user", id.User, t)
+
+	if _, err := s.IsUserBlocked(uid); err == nil {
+		t.Error("Expected an error checking a user against the blocklist")
+	}
+
+	s.Register(uid, "CODE")
+	if _, err := s.GetUser(uid.String()); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("User registered without checking the blocklist: %v", err)
+	}
+	checkCode(t, s, "CODE", 0, 0)
+}
+
+// Tests that blocked users are reported as blocked until unblocked
+func TestStorage_IsUserBlocked(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	uid := id.NewIdFromString("user", id.User, t)
+
+	err := s.BlockUser(uid.String(), "spam")
+	if err != nil {
+		t.Fatalf("Failed to block user: %+v", err)
+	}
+	if blocked, err := s.IsUserBlocked(uid); err != nil || !blocked {
+		t.Errorf("Blocked user is not reported as blocked: %t, %v", blocked, err)
+	}
+
+	err = s.UnblockUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to unblock user: %+v", err)
+	}
+	if blocked, err := s.IsUserBlocked(uid); err != nil || blocked {
+		t.Errorf("Unblocked user is reported as blocked: %t, %v", blocked, err)
+	}
+}
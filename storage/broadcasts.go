@@ -0,0 +1,109 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles announcements broadcast to registered users, which are delivered
+// gradually by the bot process
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// States of broadcasts
+const (
+	BroadcastActive    = "active"
+	BroadcastDone      = "done"
+	BroadcastCancelled = "cancelled"
+)
+
+// Segment selects the registered users a broadcast is sent to.  Users whose
+// registrations were rejected or reversed are never included.
+type Segment struct {
+	// Campaign of the code the user registered with, if set
+	Campaign string
+	// Status of the user's registration, if set
+	Status string
+}
+
+// CreateBroadcast starts a broadcast of the text to every user in the
+// segment, recording a queued delivery for each of them
+func (s *Storage) CreateBroadcast(text string, seg Segment) (*Broadcast, error) {
+	if text == "" {
+		return nil, errors.New("Broadcast text is empty")
+	}
+	switch seg.Status {
+	case "", StatusPending, StatusApproved, StatusPaid:
+	default:
+		return nil, errors.Errorf("Cannot broadcast to %s registrations", seg.Status)
+	}
+
+	recipients, err := s.GetSegment(seg.Campaign, seg.Status)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get recipients")
+	}
+
+	b := &Broadcast{
+		Text:       text,
+		Campaign:   seg.Campaign,
+		UserStatus: seg.Status,
+		State:      BroadcastActive,
+		Recipients: len(recipients),
+		CreatedAt:  time.Now(),
+	}
+	if len(recipients) == 0 {
+		b.State = BroadcastDone
+	}
+	err = s.InsertBroadcast(b, recipients)
+	if err != nil {
+		return nil, err
+	}
+	jww.INFO.Printf("Created broadcast %d to %d users", b.ID, b.Recipients)
+	return b, nil
+}
+
+// CancelBroadcast stops any further deliveries of a broadcast
+func (s *Storage) CancelBroadcast(id uint64) error {
+	return s.UpdateBroadcastState(id, BroadcastCancelled)
+}
+
+// ResumeBroadcast restarts deliveries of a cancelled broadcast from where
+// they stopped
+func (s *Storage) ResumeBroadcast(id uint64) error {
+	b, err := s.GetBroadcast(id)
+	if err != nil {
+		return err
+	} else if b.State != BroadcastCancelled {
+		return errors.Errorf("Broadcast %d is %s, not cancelled", id, b.State)
+	}
+	err = s.UpdateBroadcastState(id, BroadcastActive)
+	if err != nil {
+		return err
+	}
+
+	// Broadcasts cancelled after their last delivery have nothing to resume
+	return s.FinishBroadcast(id)
+}
+
+// FinishBroadcast completes the broadcast if nothing is left queued for it,
+// logging how its deliveries went
+func (s *Storage) FinishBroadcast(id uint64) error {
+	done, err := s.CompleteBroadcast(id)
+	if err != nil || !done {
+		return err
+	}
+
+	counts, err := s.CountDeliveries(id)
+	if err != nil {
+		return err
+	}
+	jww.INFO.Printf("Finished broadcast %d: %d sent, %d failed, %d skipped",
+		id, counts[MessageSent], counts[MessageFailed], counts[MessageSkipped])
+	return nil
+}
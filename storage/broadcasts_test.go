@@ -0,0 +1,108 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"testing"
+)
+
+// deliverAll marks every queued delivery sent, returning how many there were
+func deliverAll(t *testing.T, s *Storage) int {
+	t.Helper()
+	deliveries, err := s.GetQueuedDeliveries(100)
+	if err != nil {
+		t.Fatalf("Failed to get queued deliveries: %+v", err)
+	}
+	for _, d := range deliveries {
+		err = s.UpdateDeliveryStatus(d.BroadcastID, d.UserID, MessageSent)
+		if err != nil {
+			t.Fatalf("Failed to update delivery: %+v", err)
+		}
+	}
+	return len(deliveries)
+}
+
+// checkBroadcastState fails the test unless the broadcast is in the state
+func checkBroadcastState(t *testing.T, s *Storage, id uint64, state string) {
+	t.Helper()
+	b, err := s.GetBroadcast(id)
+	if err != nil {
+		t.Fatalf("Failed to get broadcast: %+v", err)
+	}
+	if b.State != state {
+		t.Errorf("Broadcast is %s, expected %s", b.State, state)
+	}
+}
+
+// Tests that cancelled broadcasts deliver nothing until resumed, then deliver
+// only to the recipients they had not reached, & finish once none are left
+func TestStorage_ResumeBroadcast(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	createTestCode(t, s, "CODE")
+	registerTestUser(t, s, "a", "CODE")
+	registerTestUser(t, s, "b", "CODE")
+	registerTestUser(t, s, "c", "CODE")
+
+	b, err := s.CreateBroadcast("hello", Segment{})
+	if err != nil {
+		t.Fatalf("Failed to create broadcast: %+v", err)
+	}
+	deliveries, err := s.GetQueuedDeliveries(1)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Failed to get a queued delivery: %+v, %v", deliveries, err)
+	}
+	err = s.UpdateDeliveryStatus(b.ID, deliveries[0].UserID, MessageSent)
+	if err != nil {
+		t.Fatalf("Failed to update delivery: %+v", err)
+	}
+
+	err = s.CancelBroadcast(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to cancel broadcast: %+v", err)
+	}
+	if n := deliverAll(t, s); n != 0 {
+		t.Errorf("Cancelled broadcast had %d deliveries queued", n)
+	}
+	err = s.ResumeBroadcast(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to resume broadcast: %+v", err)
+	}
+	checkBroadcastState(t, s, b.ID, BroadcastActive)
+	if n := deliverAll(t, s); n != 2 {
+		t.Errorf("Resumed broadcast had %d deliveries queued, expected 2", n)
+	}
+
+	err = s.FinishBroadcast(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to finish broadcast: %+v", err)
+	}
+	checkBroadcastState(t, s, b.ID, BroadcastDone)
+}
+
+// Tests that broadcasts cancelled after their last delivery finish when
+// resumed
+func TestStorage_ResumeBroadcast_Delivered(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	createTestCode(t, s, "CODE")
+	registerTestUser(t, s, "a", "CODE")
+
+	b, err := s.CreateBroadcast("hello", Segment{})
+	if err != nil {
+		t.Fatalf("Failed to create broadcast: %+v", err)
+	}
+	deliverAll(t, s)
+	err = s.CancelBroadcast(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to cancel broadcast: %+v", err)
+	}
+	err = s.ResumeBroadcast(b.ID)
+	if err != nil {
+		t.Fatalf("Failed to resume broadcast: %+v", err)
+	}
+	checkBroadcastState(t, s, b.ID, BroadcastDone)
+}
@@ -0,0 +1,149 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles users replacing the code they registered with
+
+package storage
+
+import (
+	"fmt"
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"time"
+)
+
+// codeChange is a change of code which passed the checks made before it is
+// applied
+type codeChange struct {
+	user    *User
+	code    *Code
+	outcome rules.Outcome
+}
+
+// checkChange runs the checks made before a user changes their code,
+// recording any refused attempt.  Returns the change to apply, or the
+// response refusing it.
+func (s *Storage) checkChange(uid *id.ID, code string) (*codeChange, string) {
+	if until, locked := s.lockedOut(uid); locked {
+		return nil, s.Text(uid.String(), "register.lockedOut", catalog.Data{"Until": formatTime(until)})
+	}
+
+	u, err := s.GetUser(uid.String())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, s.Text(uid.String(), "status.none", nil)
+	} else if err != nil {
+		return nil, s.Text(uid.String(), "register.checkError", catalog.Data{"Error": err})
+	}
+
+	switch {
+	case u.PreviousCode != "":
+		return nil, s.Text(uid.String(), "change.once", catalog.Data{"Code": u.Code})
+	case s.config.CodeChangeWindow == 0 || time.Since(u.CreatedAt) > s.config.CodeChangeWindow:
+		return nil, s.Text(uid.String(), "change.expired", catalog.Data{"Code": u.Code})
+	case u.Status != StatusPending && u.Status != StatusApproved:
+		return nil, s.Text(uid.String(), "change.status", catalog.Data{"Code": u.Code, "Status": u.Status})
+	case u.Code == code:
+		return nil, s.Text(uid.String(), "register.already", catalog.Data{"Code": u.Code})
+	}
+
+	if blocked, err := s.isCodeBlocked(code); err != nil {
+		return nil, s.Text(uid.String(), "register.checkError", catalog.Data{"Error": err})
+	} else if blocked {
+		jww.INFO.Printf("User %s attempted to change to blocked code %s", uid, code)
+		s.recordAttempt(uid, code, AttemptBlocked)
+		return nil, s.Text(uid.String(), "register.refused", catalog.Data{"Code": code})
+	}
+	c, err := s.GetCode(code)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, s.invalidCode(uid, code)
+	} else if err != nil {
+		return nil, s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	}
+	if self, err := s.isSelfReferral(uid, u.PhoneHash, c); err != nil {
+		return nil, s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	} else if self {
+		jww.WARN.Printf("Flagged %s attempting to change to their own code %s", uid, code)
+		s.recordAttempt(uid, code, AttemptSelfReferral)
+		return nil, s.Text(uid.String(), "register.selfReferral", catalog.Data{"Code": code})
+	}
+	o := s.evaluate(c, time.Now())
+	if o.Reject {
+		jww.INFO.Printf("Rules %v rejected %s changing to code %s", o.Fired, uid, code)
+		s.recordAttempt(uid, code, AttemptRejected)
+		return nil, s.Text(uid.String(), "register.refused", catalog.Data{"Code": code, "Reason": o.Message})
+	}
+
+	return &codeChange{user: u, code: c, outcome: o}, ""
+}
+
+// PreviewChange checks that the user could change their code, without
+// changing it.  Returns the prompt asking the user to confirm the change and
+// true, or the response refusing it and false.
+func (s *Storage) PreviewChange(uid *id.ID, code string) (string, bool) {
+	ch, refusal := s.checkChange(uid, code)
+	if ch == nil {
+		return refusal, false
+	}
+	return s.Text(uid.String(), "change.prompt", catalog.Data{
+		"OldCode":  ch.user.Code,
+		"Code":     code,
+		"Campaign": ch.code.Campaign,
+	}), true
+}
+
+// ChangeCode replaces the code the user registered with, if they registered
+// within the configured window & have not changed it before.  The use &
+// rewards move from the old code to the new in a single operation, which is
+// recorded in the registration's history.  Returns a response string.
+func (s *Storage) ChangeCode(uid *id.ID, code string) string {
+	ch, refusal := s.checkChange(uid, code)
+	if ch == nil {
+		return refusal
+	}
+	u, c, o := ch.user, ch.code, ch.outcome
+
+	// Debit the rewards credited through the old code & credit the new one,
+	// holding the registration for review as a new registration would be
+	status := u.Status
+	if c.Held || o.Hold || s.checkVelocity(code) {
+		status = StatusPending
+	}
+	entries, err := s.reversalEntries(u.ID)
+	if err != nil {
+		return s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	}
+	if status == StatusApproved {
+		entries = append(entries, s.rewardEntries(u.ID, code, o)...)
+	}
+
+	// The entries were computed from the registration as read above, so the
+	// change fails if its status has changed since
+	oldCode := u.Code
+	reason := fmt.Sprintf("code changed from %s to %s", oldCode, code)
+	err = s.ChangeUserCode(u.ID, oldCode, code, u.Status, status, reason, entries)
+	if errors.Is(err, ErrInvalidCode) {
+		return s.invalidCode(uid, code)
+	} else if errors.Is(err, ErrCodeChanged) {
+		return s.Text(uid.String(), "change.once", catalog.Data{"Code": oldCode})
+	} else if err != nil {
+		s.recordAttempt(uid, code, AttemptFailed)
+		return s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	}
+	jww.INFO.Printf("User %s %s", uid, reason)
+	s.recordAttempt(uid, code, AttemptSuccess)
+
+	data := catalog.Data{"OldCode": oldCode, "Code": code, "Reward": o.Total(rules.ToReferee)}
+	if status == StatusPending {
+		return s.Text(uid.String(), "change.pending", data)
+	}
+	s.codeUsed(code, o)
+	return s.Text(uid.String(), "change.success", data)
+}
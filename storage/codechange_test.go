@@ -0,0 +1,200 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// staleUserDB is a map backend returning registrations as they were before
+// a concurrent change
+type staleUserDB struct {
+	*MapImpl
+	stale *User
+}
+
+func (db *staleUserDB) GetUser(id string) (*User, error) {
+	if id == db.stale.ID {
+		u := *db.stale
+		return &u, nil
+	}
+	return db.MapImpl.GetUser(id)
+}
+
+// Tests that changing code moves the use & rewards from the old code to the
+// new, netting the old code's ledger to zero, and is only allowed once
+func TestStorage_ChangeCode(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{CodeChangeWindow: time.Hour})
+	createTestCode(t, s, "OLD")
+	createTestCode(t, s, "NEW")
+	createTestCode(t, s, "LAST")
+	uid := registerTestUser(t, s, "a", "OLD")
+
+	s.ChangeCode(uid, "NEW")
+	u, err := s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if u.Code != "NEW" || u.PreviousCode != "OLD" || u.Status != StatusApproved {
+		t.Errorf("Expected approved registration changed from OLD to NEW, got %+v", u)
+	}
+	if u.Reward != 5 {
+		t.Errorf("Referee reward is %d after changing code, expected 5", u.Reward)
+	}
+	checkCode(t, s, "OLD", 0, 0)
+	checkCode(t, s, "NEW", 1, 10)
+
+	entries, err := s.GetLedgerEntries(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get ledger entries: %+v", err)
+	}
+	net := map[string]int{}
+	for _, e := range entries {
+		if !e.Referee {
+			net[e.Code] += e.Amount
+		}
+	}
+	if net["OLD"] != 0 || net["NEW"] != 10 {
+		t.Errorf("Expected ledger to net 0 to OLD & 10 to NEW, got %v", net)
+	}
+
+	changes, err := s.GetStatusChanges(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get status changes: %+v", err)
+	}
+	if last := changes[len(changes)-1]; last.Reason != "code changed from OLD to NEW" {
+		t.Errorf("Change was recorded as %q", last.Reason)
+	}
+
+	s.ChangeCode(uid, "LAST")
+	checkCode(t, s, "NEW", 1, 10)
+	checkCode(t, s, "LAST", 0, 0)
+}
+
+// Tests that codes are not changed outside the change window
+func TestStorage_ChangeCode_Window(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{})
+	createTestCode(t, s, "OLD")
+	createTestCode(t, s, "NEW")
+	uid := registerTestUser(t, s, "a", "OLD")
+
+	s.ChangeCode(uid, "NEW")
+	checkCode(t, s, "OLD", 1, 10)
+	checkCode(t, s, "NEW", 0, 0)
+
+	s.config.CodeChangeWindow = time.Hour
+	u, err := s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	u.CreatedAt = time.Now().Add(-2 * time.Hour)
+	s.ChangeCode(uid, "NEW")
+	checkCode(t, s, "OLD", 1, 10)
+	checkCode(t, s, "NEW", 0, 0)
+}
+
+// Tests that the user's own code follows them to the new code, so credits up
+// the referral chain from it no longer reach the abandoned code
+func TestStorage_ChangeCode_OwnedCodeParent(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{CodeChangeWindow: time.Hour})
+	createTestCode(t, s, "OLD")
+	createTestCode(t, s, "NEW")
+	a := registerTestUser(t, s, "a", "OLD")
+	s.IssueCode(a)
+
+	s.ChangeCode(a, "NEW")
+	owned, err := s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get code of a: %+v", err)
+	}
+	if owned.ParentCode != "NEW" {
+		t.Fatalf("Code of a has parent %q after changing code, expected NEW", owned.ParentCode)
+	}
+
+	registerTestUser(t, s, "b", owned.Code)
+	checkCode(t, s, "OLD", 0, 0)
+	checkCode(t, s, "NEW", 1, 13)
+}
+
+// Tests that changing to a held code debits the old code, holds the
+// registration & only credits the new code once approved
+func TestStorage_ChangeCode_Held(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{CodeChangeWindow: time.Hour})
+	createTestCode(t, s, "OLD")
+	createTestCode(t, s, "HELD")
+	err := s.HoldCode("HELD")
+	if err != nil {
+		t.Fatalf("Failed to hold code: %+v", err)
+	}
+	a := registerTestUser(t, s, "a", "OLD")
+	s.IssueCode(a)
+
+	s.ChangeCode(a, "HELD")
+	u, err := s.GetUser(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if u.Status != StatusPending || u.Reward != 0 {
+		t.Errorf("Expected pending registration without rewards, got %+v", u)
+	}
+	checkCode(t, s, "OLD", 0, 0)
+	checkCode(t, s, "HELD", 0, 0)
+	owned, err := s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get code of a: %+v", err)
+	}
+	if owned.ParentCode != "" {
+		t.Errorf("Code of a has parent %q while the change is pending", owned.ParentCode)
+	}
+
+	err = s.ApproveRegistration(a.String(), "checked")
+	if err != nil {
+		t.Fatalf("Failed to approve registration: %+v", err)
+	}
+	checkCode(t, s, "HELD", 1, 10)
+	owned, err = s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get code of a: %+v", err)
+	}
+	if owned.ParentCode != "HELD" {
+		t.Errorf("Code of a has parent %q after approval, expected HELD", owned.ParentCode)
+	}
+}
+
+// Tests that a code change is refused if the registration's status changed
+// after it was checked, without crediting the new code
+func TestStorage_ChangeCode_StaleStatus(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{CodeChangeWindow: time.Hour})
+	createTestCode(t, s, "OLD")
+	createTestCode(t, s, "NEW")
+	uid := registerTestUser(t, s, "a", "OLD")
+	u, err := s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	stale := *u
+
+	err = s.ReverseRegistration(uid.String(), "fraud", false)
+	if err != nil {
+		t.Fatalf("Failed to reverse registration: %+v", err)
+	}
+	s.database = &staleUserDB{MapImpl: s.database.(*MapImpl), stale: &stale}
+	s.ChangeCode(uid, "NEW")
+
+	u, err = s.database.(*staleUserDB).MapImpl.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if u.Code != "OLD" || u.Status != StatusReversed {
+		t.Errorf("Expected reversed registration with OLD, got %+v", u)
+	}
+	checkCode(t, s, "OLD", 0, 0)
+	checkCode(t, s, "NEW", 0, 0)
+	checkLedgerNets(t, s, uid)
+}
@@ -0,0 +1,196 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the management of referral codes
+
+package storage
+
+import (
+	"crypto/rand"
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Characters used in generated codes, excluding easily confused characters
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Length of generated codes
+const codeLength = 8
+
+// Number of times to retry generating a code which is already taken
+const codeRetries = 5
+
+// CreateCode adds a new referral code to a campaign.  The owner ID, payout
+// address & tags are optional.
+func (s *Storage) CreateCode(code, campaign, ownerID, payoutAddress string, tags []string) error {
+	if ownerID != "" {
+		if _, err := ParseUserID(ownerID); err != nil {
+			return errors.WithMessagef(err, "Invalid owner ID %s", ownerID)
+		}
+	}
+	return s.InsertCode(&Code{
+		Code:          code,
+		Campaign:      campaign,
+		OwnerID:       ownerID,
+		PayoutAddress: payoutAddress,
+		Tags:          strings.Join(tags, ","),
+		CreatedAt:     time.Now(),
+	})
+}
+
+// TagList returns the tags of the code
+func (c *Code) TagList() []string {
+	if c.Tags == "" {
+		return nil
+	}
+	return strings.Split(c.Tags, ",")
+}
+
+// IssueCode returns the personal referral code of the user, generating one if
+// they are eligible and do not have one yet.  Returns a response string.
+func (s *Storage) IssueCode(uid *id.ID) string {
+	// Return the existing code if there is one
+	c, err := s.GetOwnedCode(uid.String())
+	if err == nil {
+		return s.Text(uid.String(), "mycode.existing", catalog.Data{"Code": c.Code})
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return s.Text(uid.String(), "mycode.lookupError", catalog.Data{"Error": err})
+	}
+
+	// Check eligibility
+	phoneHash, err := s.GetPhoneHash(uid)
+	if err != nil {
+		return s.Text(uid.String(), "mycode.udbError", catalog.Data{"Error": err})
+	} else if phoneHash == nil {
+		return s.Text(uid.String(), "mycode.noPhone", nil)
+	}
+	var parent, campaign string
+	u, err := s.GetUser(uid.String())
+	switch {
+	case err == nil && countsTowardsCode(u.Status):
+		parent = u.Code
+		if pc, err := s.GetCode(parent); err == nil {
+			campaign = pc.Campaign
+		}
+	case err == nil && (u.Status == StatusRejected || u.Status == StatusReversed):
+		return s.Text(uid.String(), "mycode.ineligible", catalog.Data{"Status": u.Status})
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		return s.Text(uid.String(), "register.checkError", catalog.Data{"Error": err})
+	case s.config.OwnCodeRequiresRegistration:
+		return s.Text(uid.String(), "mycode.notRegistered", nil)
+	}
+
+	c, err = s.issueCode(uid.String(), parent, campaign)
+	if err != nil {
+		return s.Text(uid.String(), "mycode.error", catalog.Data{"Error": err})
+	}
+	return s.Text(uid.String(), "mycode.issued", catalog.Data{"Code": c.Code})
+}
+
+// CodeStats describes the usage & rewards of the user's referral code.
+// Returns a response string.
+func (s *Storage) CodeStats(uid *id.ID) string {
+	c, err := s.GetOwnedCode(uid.String())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s.Text(uid.String(), "stats.none", nil)
+	} else if err != nil {
+		return s.Text(uid.String(), "mycode.lookupError", catalog.Data{"Error": err})
+	}
+	return s.Text(uid.String(), "stats", catalog.Data{"Code": c.Code, "Uses": c.Uses, "Total": c.Total})
+}
+
+// SetPayoutAddress sets the address the rewards of the user's referral code
+// are paid out to.  Returns the code.
+func (s *Storage) SetPayoutAddress(uid, address string) (string, error) {
+	c, err := s.GetOwnedCode(uid)
+	if err != nil {
+		return "", err
+	}
+	return c.Code, s.UpdateCodeOwner(c.Code, uid, address)
+}
+
+// issueCode generates a new code owned by the user in the campaign, recording
+// the code the user registered with as its parent.  Returns the user's
+// existing code instead if one was issued to them concurrently.
+func (s *Storage) issueCode(ownerID, parent, campaign string) (*Code, error) {
+	var err error
+	for i := 0; i < codeRetries; i++ {
+		c := &Code{
+			OwnerID:    ownerID,
+			ParentCode: parent,
+			Campaign:   campaign,
+			CreatedAt:  time.Now(),
+		}
+		c.Code, err = generateCode()
+		if err != nil {
+			return nil, err
+		}
+		err = s.InsertCode(c)
+		if err == nil {
+			jww.INFO.Printf("Issued code %s to %s", c.Code, ownerID)
+			return c, nil
+		}
+
+		// Users own at most one code, so a concurrent request may have
+		// issued the user's code first
+		if owned, ownedErr := s.GetOwnedCode(ownerID); ownedErr == nil {
+			return owned, nil
+		}
+		jww.WARN.Printf("Failed to insert generated code %s: %+v", c.Code, err)
+	}
+	return nil, errors.WithMessage(err, "Failed to generate a unique code")
+}
+
+// generateCode returns a random code
+func generateCode() (string, error) {
+	code := make([]byte, codeLength)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// SetCodeOwner sets the user a code belongs to & the address its rewards are
+// paid out to
+func (s *Storage) SetCodeOwner(code, ownerID, payoutAddress string) error {
+	if ownerID != "" {
+		if _, err := ParseUserID(ownerID); err != nil {
+			return errors.WithMessagef(err, "Invalid owner ID %s", ownerID)
+		}
+	}
+	return s.UpdateCodeOwner(code, ownerID, payoutAddress)
+}
+
+// ReleaseCode lifts the review hold placed on a code.  Registrations already
+// pending review must still be approved or rejected individually.
+func (s *Storage) ReleaseCode(code string) error {
+	_, err := s.GetCode(code)
+	if err != nil {
+		return err
+	}
+	return s.SetCodeHeld(code, false)
+}
+
+// HoldCode holds all further registrations using the code for review
+func (s *Storage) HoldCode(code string) error {
+	_, err := s.GetCode(code)
+	if err != nil {
+		return err
+	}
+	return s.SetCodeHeld(code, true)
+}
@@ -0,0 +1,145 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"fmt"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+)
+
+// Tests that a code issued before its owner registers gets the code they
+// register with as its parent, so credits up the referral chain reach it
+func TestStorage_IssueCode_BeforeRegistering(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{})
+	createTestCode(t, s, "ROOT")
+
+	a := id.NewIdFromString("a", id.User, t)
+	s.IssueCode(a)
+	owned, err := s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to issue code to a: %+v", err)
+	}
+	if owned.ParentCode != "" {
+		t.Fatalf("Code issued before registering has parent %s", owned.ParentCode)
+	}
+
+	registerTestUser(t, s, "a", "ROOT")
+	owned, err = s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get code of a: %+v", err)
+	}
+	if owned.ParentCode != "ROOT" {
+		t.Errorf("Code of a has parent %q after registering, expected ROOT", owned.ParentCode)
+	}
+
+	registerTestUser(t, s, "b", owned.Code)
+	checkCode(t, s, owned.Code, 1, 10)
+	checkCode(t, s, "ROOT", 1, 13)
+}
+
+// Tests that a code issued before its owner registers gets a parent once a
+// registration held for review is approved, but not while it is pending
+func TestStorage_IssueCode_BeforeApproval(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{})
+	createTestCode(t, s, "HELD")
+	err := s.HoldCode("HELD")
+	if err != nil {
+		t.Fatalf("Failed to hold code: %+v", err)
+	}
+
+	a := id.NewIdFromString("a", id.User, t)
+	s.IssueCode(a)
+	registerTestUser(t, s, "a", "HELD")
+	owned, err := s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to issue code to a: %+v", err)
+	}
+	if owned.ParentCode != "" {
+		t.Errorf("Code has parent %s while its owner's registration is pending", owned.ParentCode)
+	}
+
+	err = s.ApproveRegistration(a.String(), "checked")
+	if err != nil {
+		t.Fatalf("Failed to approve registration: %+v", err)
+	}
+	owned, err = s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get code of a: %+v", err)
+	}
+	if owned.ParentCode != "HELD" {
+		t.Errorf("Code of a has parent %q after approval, expected HELD", owned.ParentCode)
+	}
+}
+
+// Tests that users are issued a single code, even if another request issued
+// them one first
+func TestStorage_IssueCode_Once(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	uid := id.NewIdFromString("user", id.User, t)
+
+	s.IssueCode(uid)
+	owned, err := s.GetOwnedCode(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to issue code: %+v", err)
+	}
+	strResponse := s.IssueCode(uid)
+	expected := fmt.Sprintf("Your referral code is %s", owned.Code)
+	if strResponse != expected {
+		t.Errorf("Expected response %q, got %q", expected, strResponse)
+	}
+
+	// A request which lost the race to issue the code returns the winner's
+	c, err := s.issueCode(uid.String(), "", "")
+	if err != nil {
+		t.Fatalf("Failed to issue code: %+v", err)
+	}
+	if c.Code != owned.Code {
+		t.Errorf("Issued second code %s to the owner of %s", c.Code, owned.Code)
+	}
+
+	err = s.CreateCode("OTHER", "", uid.String(), "", nil)
+	if err == nil {
+		t.Error("Created a second code owned by the user")
+	}
+	createTestCode(t, s, "OTHER")
+	err = s.SetCodeOwner("OTHER", uid.String(), "")
+	if err == nil {
+		t.Error("Assigned a second code to the user")
+	}
+}
+
+// Tests that users whose registration was rejected or reversed are not issued
+// a code
+func TestStorage_IssueCode_Ineligible(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	createTestCode(t, s, "HELD")
+	err := s.HoldCode("HELD")
+	if err != nil {
+		t.Fatalf("Failed to hold code: %+v", err)
+	}
+	createTestCode(t, s, "CODE")
+
+	rejected := registerTestUser(t, s, "rejected", "HELD")
+	err = s.RejectRegistration(rejected.String(), "fraud")
+	if err != nil {
+		t.Fatalf("Failed to reject registration: %+v", err)
+	}
+	reversed := registerTestUser(t, s, "reversed", "CODE")
+	err = s.ReverseRegistration(reversed.String(), "fraud", false)
+	if err != nil {
+		t.Fatalf("Failed to reverse registration: %+v", err)
+	}
+
+	for _, uid := range []*id.ID{rejected, reversed} {
+		s.IssueCode(uid)
+		if c, err := s.GetOwnedCode(uid.String()); err == nil {
+			t.Errorf("Issued code %s to a user who is not eligible", c.Code)
+		}
+	}
+}
@@ -22,8 +22,63 @@ import (
 // database interface holds function definitions for storage
 type database interface {
 	CheckUser(id string) (string, error)
-	UseCode(id, code string) error
-	CheckRegStatus(id *id.ID) (bool, error)
+	UseCode(u *User, entries []*LedgerEntry) error
+	GetUser(id string) (*User, error)
+	GetUsersByStatus(status string, limit int) ([]*User, error)
+	GetUsersSince(since time.Time) ([]*User, error)
+	UpdateUserStatus(id, oldStatus, newStatus, reason string, entries []*LedgerEntry) error
+	ChangeUserCode(id, oldCode, newCode, oldStatus, newStatus, reason string, entries []*LedgerEntry) error
+	GetStatusChanges(id string) ([]*StatusChange, error)
+	GetLedgerEntries(id string) ([]*LedgerEntry, error)
+	AwardMilestone(a *MilestoneAward, entry *LedgerEntry) (bool, error)
+	InsertCode(c *Code) error
+	GetCode(code string) (*Code, error)
+	GetOwnedCode(ownerID string) (*Code, error)
+	UpdateCodeOwner(code, ownerID, payoutAddress string) error
+	SetCodeHeld(code string, held bool) error
+	CountCodeUses(code string, since time.Time) (int64, error)
+	GetPhoneHash(id *id.ID) ([]byte, error)
+	CheckPhoneHash(phoneHash []byte) (string, error)
+	GetUsersWithoutPhoneHash() ([]*User, error)
+	SetUserPhoneHash(id string, phoneHash []byte) error
+	InsertAttempt(a *Attempt) error
+	CountFailedAttempts(id string, since time.Time) (int64, error)
+	GetAttemptsByResult(result string, since time.Time) ([]*Attempt, error)
+	GetLockout(id string) (*Lockout, error)
+	UpsertLockout(l *Lockout) error
+	UpsertBlockedUser(b *BlockedUser) error
+	DeleteBlockedUser(id string) error
+	CheckBlockedUser(id string) (bool, error)
+	GetBlockedUsers() ([]*BlockedUser, error)
+	UpsertBlockedCode(b *BlockedCode) error
+	DeleteBlockedCode(code string) error
+	CheckBlockedCode(code string) (bool, error)
+	GetBlockedCodes() ([]*BlockedCode, error)
+	GetPreference(id string) (*Preference, error)
+	UpsertPreference(p *Preference) error
+	InsertMessage(m *Message) error
+	GetQueuedMessages(limit int) ([]*Message, error)
+	GetMessagesByStatus(status string) ([]*Message, error)
+	CountMessages(recipient, kind string, since time.Time) (int64, error)
+	UpdateMessageStatus(id uint64, status string) error
+	QueueDigest(digest *Message, digested []uint64) error
+	GetSegment(campaign, status string) ([]string, error)
+	InsertBroadcast(b *Broadcast, recipients []string) error
+	GetBroadcast(id uint64) (*Broadcast, error)
+	GetBroadcasts() ([]*Broadcast, error)
+	UpdateBroadcastState(id uint64, state string) error
+	GetQueuedDeliveries(limit int) ([]*Delivery, error)
+	UpdateDeliveryStatus(broadcastID uint64, userID, status string) error
+	CountDeliveries(broadcastID uint64) (map[string]int64, error)
+	CompleteBroadcast(id uint64) (bool, error)
+	InsertWelcomeAssignment(w *WelcomeAssignment) error
+	GetWelcomeAssignment(id string) (*WelcomeAssignment, error)
+	GetWelcomeStats() ([]*WelcomeStats, error)
+	GetConversation(id string) (*Conversation, error)
+	UpsertConversation(c *Conversation) error
+	DeleteConversation(id string) error
+	InsertAdminAction(a *AdminAction) error
+	GetAdminActions(limit int) ([]*AdminAction, error)
 }
 
 // DatabaseImpl struct implements the database interface with an underlying DB
@@ -36,24 +91,207 @@ type Code struct {
 	Code  string `gorm:"primary_key;"`
 	Uses  int    `gorm:"not null"`
 	Total int    `gorm:"not null"`
-	Users []User `gorm:"foreignKey:code;references:code"`
+	// Registrations using a held code are not credited until reviewed
+	Held bool `gorm:"not null;default:false"`
+	// ID of the user the code belongs to, if any.  Users own at most one code.
+	OwnerID string `gorm:"uniqueIndex:idx_codes_owner,where:owner_id <> ''"`
+	// Address the code's rewards are paid out to
+	PayoutAddress string
+	// Code the owner registered with when this code was issued to them
+	ParentCode string `gorm:"index"`
+	// Campaign the code belongs to, which determines the rules applied to it
+	Campaign string `gorm:"not null;default:'';index"`
+	// Comma separated labels matched by the reward rules
+	Tags      string `gorm:"not null;default:''"`
+	CreatedAt time.Time
+	Users     []User `gorm:"foreignKey:code;references:code"`
 }
 
 type User struct {
 	ID   string `gorm:"primary_key"`
 	Code string `gorm:"not null"`
+	// Hash of the UD phone fact the user registered with
+	PhoneHash []byte    `gorm:"uniqueIndex"`
+	Status    string    `gorm:"not null;default:approved"`
+	CreatedAt time.Time `gorm:"index"`
+	// Total rewards credited to the user for registering
+	Reward int `gorm:"not null;default:0"`
+	// Code the user first registered with, if they have changed it
+	PreviousCode string `gorm:"not null;default:''"`
+}
+
+// StatusChange records a registration moving between states
+type StatusChange struct {
+	ID        uint64    `gorm:"primary_key;autoIncrement"`
+	UserID    string    `gorm:"not null;index"`
+	OldStatus string    `gorm:"not null"`
+	NewStatus string    `gorm:"not null"`
+	Reason    string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// LedgerEntry records a reward credited to (or debited from) a code, or to
+// the registering user
+type LedgerEntry struct {
+	ID uint64 `gorm:"primary_key;autoIncrement"`
+	// Registration the entry was made for
+	UserID string `gorm:"not null;index"`
+	Code   string `gorm:"not null;index"`
+	Amount int    `gorm:"not null"`
+	// Distance up the referral chain from the code used to register
+	Tier int `gorm:"not null;default:0"`
+	// Credited to the registering user rather than the code
+	Referee   bool      `gorm:"not null;default:false"`
+	Kind      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// MilestoneAward records a code reaching a milestone number of uses, ensuring
+// each milestone bonus is credited once
+type MilestoneAward struct {
+	Code      string    `gorm:"primary_key"`
+	Uses      int       `gorm:"primary_key;autoIncrement:false"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// Attempt records a single code submission made to the bot
+type Attempt struct {
+	ID        uint64    `gorm:"primary_key;autoIncrement"`
+	UserID    string    `gorm:"not null;index"`
+	Code      string    `gorm:"not null"`
+	Result    string    `gorm:"not null"`
+	Timestamp time.Time `gorm:"not null;index"`
+}
+
+// Lockout records the time until which a user may not submit codes
+type Lockout struct {
+	UserID string    `gorm:"primary_key"`
+	Until  time.Time `gorm:"not null"`
+}
+
+// BlockedUser is a user barred from registering or contacting the bot
+type BlockedUser struct {
+	ID        string    `gorm:"primary_key"`
+	Reason    string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// BlockedCode is a code which may no longer be used to register
+type BlockedCode struct {
+	Code      string    `gorm:"primary_key"`
+	Reason    string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// Preference holds a user's settings for messages initiated by the bot
+type Preference struct {
+	UserID string `gorm:"primary_key"`
+	// One of NotifyAll, NotifyDigest or NotifyNone
+	Notifications string `gorm:"not null"`
+	// Language the bot's messages are sent in; empty for the default
+	Language  string    `gorm:"not null;default:''"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+// Message is a bot-initiated message queued for delivery over cMix
+type Message struct {
+	ID   uint64 `gorm:"primary_key;autoIncrement"`
+	Kind string `gorm:"not null"`
+	// ID of the receiving user; alerts have no recipient and go to all admins
+	Recipient string `gorm:"not null;index"`
+	// Code the message concerns, if any
+	Code      string
+	Text      string    `gorm:"not null"`
+	Status    string    `gorm:"not null;index"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// Broadcast is an announcement sent to all registered users, or a segment of
+// them
+type Broadcast struct {
+	ID   uint64 `gorm:"primary_key;autoIncrement"`
+	Text string `gorm:"not null"`
+	// Only users registered with a code in this campaign, if set
+	Campaign string `gorm:"not null;default:''"`
+	// Only users whose registration has this status, if set
+	UserStatus string `gorm:"not null;default:''"`
+	// One of BroadcastActive, BroadcastDone or BroadcastCancelled
+	State      string    `gorm:"not null;index"`
+	Recipients int       `gorm:"not null"`
+	CreatedAt  time.Time `gorm:"not null"`
+}
+
+// Delivery is the delivery state of a broadcast to one recipient, persisted
+// so an interrupted broadcast resumes where it left off
+type Delivery struct {
+	BroadcastID uint64 `gorm:"primary_key;autoIncrement:false"`
+	UserID      string `gorm:"primary_key"`
+	// One of MessageQueued, MessageSent, MessageFailed or MessageSkipped
+	Status    string `gorm:"not null;index"`
+	UpdatedAt time.Time
+}
+
+// WelcomeAssignment records the welcome variant a user was sent
+type WelcomeAssignment struct {
+	UserID    string    `gorm:"primary_key"`
+	Campaign  string    `gorm:"not null;default:''"`
+	Variant   string    `gorm:"not null;index"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// WelcomeStats counts the users sent a welcome variant who went on to
+// submit a code & to register
+type WelcomeStats struct {
+	Campaign   string
+	Variant    string
+	Assigned   int64
+	Submitted  int64
+	Registered int64
+}
+
+// Conversation is the state of a multi-step exchange between a user & the bot
+type Conversation struct {
+	UserID string `gorm:"primary_key"`
+	State  string `gorm:"not null"`
+	// JSON encoded values carried between steps
+	Data      string    `gorm:"not null;default:''"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// AdminAction records a command run by an admin over cMix
+type AdminAction struct {
+	ID        uint64    `gorm:"primary_key;autoIncrement"`
+	AdminID   string    `gorm:"not null;index"`
+	Command   string    `gorm:"not null"`
+	Response  string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
 }
 
 // MapImpl struct implements the database interface with an underlying Map
 type MapImpl struct {
-	coupons map[string]*Code
-	users   map[string]*Code
+	coupons       map[string]*Code
+	users         map[string]*User
+	attempts      []*Attempt
+	lockouts      map[string]*Lockout
+	messages      []*Message
+	changes       []*StatusChange
+	ledger        []*LedgerEntry
+	blockedUsers  map[string]*BlockedUser
+	blockedCodes  map[string]*BlockedCode
+	preferences   map[string]*Preference
+	milestones    map[MilestoneAward]bool
+	adminActions  []*AdminAction
+	broadcasts    []*Broadcast
+	deliveries    []*Delivery
+	welcomes      map[string]*WelcomeAssignment
+	conversations map[string]*Conversation
 	sync.RWMutex
 }
 
-// newDatabase initializes the database interface
+// newDatabase initializes the database interface.  Unless the database is
+// required, falls back to the map backend if it is unavailable.
 // Returns a database interface and error
-func newDatabase(params Params, udbParams Params) (database, error) {
+func newDatabase(params Params, udbParams Params, requireDatabase bool) (database, error) {
 	var err, udbErr error
 	var db, udbDb *gorm.DB
 	// Connect to the database if the correct information is provided
@@ -70,19 +308,27 @@ func newDatabase(params Params, udbParams Params) (database, error) {
 			connectString += fmt.Sprintf(" password=%s", params.Password)
 		}
 		if len(udbParams.Password) > 0 {
-			connectString += fmt.Sprintf(" password=%s", udbParams.Password)
+			udConnectString += fmt.Sprintf(" password=%s", udbParams.Password)
 		}
 		db, err = gorm.Open(postgres.Open(connectString), &gorm.Config{
 			Logger: logger.New(jww.TRACE, logger.Config{LogLevel: logger.Info}),
 		})
-		udbDb, err = gorm.Open(postgres.Open(udConnectString), &gorm.Config{
+		udbDb, udbErr = gorm.Open(postgres.Open(udConnectString), &gorm.Config{
 			Logger: logger.New(jww.TRACE, logger.Config{LogLevel: logger.Info}),
 		})
 	}
 
 	// Return the map-backend interface
 	// in the event there is a database error or information is not provided
-	if (params.Address == "" && params.Port == "" && udbParams.Address == "" && udbParams.Port == "") || err != nil || udbErr != nil {
+	if db == nil || err != nil || udbErr != nil {
+		if requireDatabase {
+			if err != nil {
+				return nil, errors.WithMessage(err, "Unable to initialize database backend")
+			} else if udbErr != nil {
+				return nil, errors.WithMessage(udbErr, "Unable to initialize UDB database backend")
+			}
+			return nil, errors.New("Database backend connection information not provided")
+		}
 
 		if err != nil {
 			jww.WARN.Printf("Unable to initialize database backend: %+v", err)
@@ -94,7 +340,17 @@ func newDatabase(params Params, udbParams Params) (database, error) {
 
 		defer jww.INFO.Println("Map backend initialized successfully!")
 
-		mapImpl := &MapImpl{}
+		mapImpl := &MapImpl{
+			coupons:       map[string]*Code{},
+			users:         map[string]*User{},
+			lockouts:      map[string]*Lockout{},
+			blockedUsers:  map[string]*BlockedUser{},
+			blockedCodes:  map[string]*BlockedCode{},
+			preferences:   map[string]*Preference{},
+			milestones:    map[MilestoneAward]bool{},
+			welcomes:      map[string]*WelcomeAssignment{},
+			conversations: map[string]*Conversation{},
+		}
 
 		return database(mapImpl), nil
 	}
@@ -115,7 +371,9 @@ func newDatabase(params Params, udbParams Params) (database, error) {
 
 	// Initialize the database schema
 	// WARNING: Order is important. Do not change without database testing
-	models := []interface{}{Code{}, User{}}
+	models := []interface{}{Code{}, User{}, StatusChange{}, LedgerEntry{}, MilestoneAward{},
+		Attempt{}, Lockout{}, BlockedUser{}, BlockedCode{}, Preference{}, Message{}, Broadcast{}, Delivery{},
+		WelcomeAssignment{}, Conversation{}, AdminAction{}}
 	for _, model := range models {
 		err = db.AutoMigrate(model)
 		if err != nil {
@@ -123,6 +381,29 @@ func newDatabase(params Params, udbParams Params) (database, error) {
 		}
 	}
 
+	err = backfillLedger(db)
+	if err != nil {
+		return database(&DatabaseImpl{}), err
+	}
+
 	jww.INFO.Println("Database backend initialized successfully!")
 	return &DatabaseImpl{db: db, udbDB: udbDb}, nil
 }
+
+// backfillLedger records the reward credited to the code of each registration
+// made before rewards were recorded in the ledger, so reversing them debits
+// the code.  These registrations are the ones with no recorded state changes.
+func backfillLedger(db *gorm.DB) error {
+	result := db.Exec("insert into ledger_entries (user_id, code, amount, tier, referee, kind, created_at) "+
+		"select users.id, users.code, ?, 0, false, ?, coalesce(users.created_at, ?) from users "+
+		"where users.status in ? "+
+		"and not exists (select 1 from ledger_entries where ledger_entries.user_id = users.id) "+
+		"and not exists (select 1 from status_changes where status_changes.user_id = users.id)",
+		legacyReferralReward, LedgerReferral, time.Now(), []string{StatusApproved, StatusPaid})
+	if result.Error != nil {
+		return errors.WithMessage(result.Error, "Failed to backfill ledger")
+	} else if result.RowsAffected > 0 {
+		jww.INFO.Printf("Backfilled ledger entries of %d registrations", result.RowsAffected)
+	}
+	return nil
+}
@@ -8,10 +8,13 @@
 package storage
 
 import (
+	"database/sql"
 	"github.com/pkg/errors"
 	"gitlab.com/elixxir/primitives/fact"
 	"gitlab.com/xx_network/primitives/id"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
 )
 
 func (db *DatabaseImpl) CheckUser(id string) (string, error) {
@@ -23,35 +26,639 @@ func (db *DatabaseImpl) CheckUser(id string) (string, error) {
 	return u.Code, nil
 }
 
-func (db *DatabaseImpl) UseCode(id, code string) error {
+func (db *DatabaseImpl) UseCode(u *User, entries []*LedgerEntry) error {
 	return db.db.Transaction(func(tx *gorm.DB) error {
-		u := &User{
-			ID:   id,
-			Code: code,
-		}
-		err := tx.Create(&u).Error
+		err := tx.Create(u).Error
 		if err != nil {
 			return errors.WithMessage(err, "Failed to add user")
 		}
 
-		c := &Code{}
-		err = tx.Model(&c).Where("code = ?", code).
-			Updates(map[string]interface{}{
-				"uses":  gorm.Expr("uses + ?", 1),
-				"total": gorm.Expr("total + ?", 10),
-			}).Error
+		// Registrations held for review do not count towards the code
+		uses := 0
+		if countsTowardsCode(u.Status) {
+			uses = 1
+		}
+		result := tx.Model(&Code{}).Where("code = ?", u.Code).
+			Update("uses", gorm.Expr("uses + ?", uses))
+		if result.Error != nil {
+			return errors.WithMessage(result.Error, "Failed to use code")
+		} else if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+
+		if countsTowardsCode(u.Status) {
+			err = adoptParentCode(tx, u.ID, u.Code)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = applyEntries(tx, entries)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&StatusChange{
+			UserID:    u.ID,
+			NewStatus: u.Status,
+			Reason:    "registered",
+			CreatedAt: u.CreatedAt,
+		}).Error
+	})
+}
+
+func (db *DatabaseImpl) GetUser(id string) (*User, error) {
+	u := &User{}
+	err := db.db.Where("id = ?", id).Take(u).Error
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (db *DatabaseImpl) GetUsersByStatus(status string, limit int) ([]*User, error) {
+	var users []*User
+	err := db.db.Where("status = ?", status).
+		Order("created_at").Limit(limit).Find(&users).Error
+	return users, err
+}
+
+func (db *DatabaseImpl) GetUsersSince(since time.Time) ([]*User, error) {
+	var users []*User
+	err := db.db.Where("created_at >= ?", since).Order("created_at").Find(&users).Error
+	return users, err
+}
+
+func (db *DatabaseImpl) UpdateUserStatus(id, oldStatus, newStatus, reason string, entries []*LedgerEntry) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		u := &User{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", id).Take(u).Error
+		if err != nil {
+			return err
+		} else if u.Status != oldStatus {
+			return errors.WithMessagef(ErrInvalidTransition,
+				"registration is %s, not %s", u.Status, oldStatus)
+		}
+
+		err = tx.Model(u).Update("status", newStatus).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to update status")
+		}
+
+		// Keep the code's use count in line with the counted registrations
+		uses := 0
+		if countsTowardsCode(newStatus) && !countsTowardsCode(oldStatus) {
+			uses = 1
+		} else if !countsTowardsCode(newStatus) && countsTowardsCode(oldStatus) {
+			uses = -1
+		}
+		if uses != 0 {
+			err = tx.Model(&Code{}).Where("code = ?", u.Code).
+				Update("uses", gorm.Expr("uses + ?", uses)).Error
+			if err != nil {
+				return errors.WithMessage(err, "Failed to update code uses")
+			}
+		}
+		if uses > 0 {
+			err = adoptParentCode(tx, id, u.Code)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = applyEntries(tx, entries)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&StatusChange{
+			UserID:    id,
+			OldStatus: oldStatus,
+			NewStatus: newStatus,
+			Reason:    reason,
+			CreatedAt: time.Now(),
+		}).Error
+	})
+}
+
+func (db *DatabaseImpl) ChangeUserCode(id, oldCode, newCode, oldStatus, newStatus, reason string, entries []*LedgerEntry) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		u := &User{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", id).Take(u).Error
+		if err != nil {
+			return err
+		} else if u.PreviousCode != "" {
+			return ErrCodeChanged
+		} else if u.Code != oldCode {
+			return errors.Errorf("registration uses code %s, not %s", u.Code, oldCode)
+		} else if u.Status != oldStatus {
+			return errors.WithMessagef(ErrInvalidTransition,
+				"registration is %s, not %s", u.Status, oldStatus)
+		}
+
+		// Move the use from the old code to the new
+		if countsTowardsCode(oldStatus) {
+			err = tx.Model(&Code{}).Where("code = ?", oldCode).
+				Update("uses", gorm.Expr("uses - 1")).Error
+			if err != nil {
+				return errors.WithMessage(err, "Failed to update code uses")
+			}
+		}
+		uses := 0
+		if countsTowardsCode(newStatus) {
+			uses = 1
+		}
+		result := tx.Model(&Code{}).Where("code = ?", newCode).
+			Update("uses", gorm.Expr("uses + ?", uses))
+		if result.Error != nil {
+			return errors.WithMessage(result.Error, "Failed to update code uses")
+		} else if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+
+		err = tx.Model(u).Updates(map[string]interface{}{
+			"code":          newCode,
+			"previous_code": oldCode,
+			"status":        newStatus,
+		}).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to update code")
+		}
+
+		// Codes the user owns follow them to the new code once it counts
+		parent := ""
+		if countsTowardsCode(newStatus) {
+			parent = newCode
+		}
+		err = tx.Model(&Code{}).Where("owner_id = ? and parent_code = ?", id, oldCode).
+			Update("parent_code", parent).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to update parent code")
+		}
+		if countsTowardsCode(newStatus) {
+			err = adoptParentCode(tx, id, newCode)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = applyEntries(tx, entries)
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&StatusChange{
+			UserID:    id,
+			OldStatus: oldStatus,
+			NewStatus: newStatus,
+			Reason:    reason,
+			CreatedAt: time.Now(),
+		}).Error
+	})
+}
+
+func (db *DatabaseImpl) GetStatusChanges(id string) ([]*StatusChange, error) {
+	var changes []*StatusChange
+	err := db.db.Where("user_id = ?", id).Order("id").Find(&changes).Error
+	return changes, err
+}
+
+func (db *DatabaseImpl) GetLedgerEntries(id string) ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	err := db.db.Where("user_id = ?", id).Order("id").Find(&entries).Error
+	return entries, err
+}
+
+func (db *DatabaseImpl) AwardMilestone(a *MilestoneAward, entry *LedgerEntry) (bool, error) {
+	awarded := false
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(a)
+		if result.Error != nil {
+			return errors.WithMessage(result.Error, "Failed to record milestone")
+		} else if result.RowsAffected == 0 {
+			// Already awarded
+			return nil
+		}
+		awarded = true
+		return applyEntries(tx, []*LedgerEntry{entry})
+	})
+	return awarded && err == nil, err
+}
+
+// adoptParentCode records the code the user registered with as the parent of
+// the codes they own which have none, so credits up the referral chain from
+// codes issued before they registered reach it
+func adoptParentCode(tx *gorm.DB, ownerID, parent string) error {
+	err := tx.Model(&Code{}).
+		Where("owner_id = ? and code <> ? and (parent_code = '' or parent_code is null)", ownerID, parent).
+		Update("parent_code", parent).Error
+	return errors.WithMessage(err, "Failed to set parent code")
+}
+
+// applyEntries records ledger entries & adds them to the credited codes' or
+// referees' totals
+func applyEntries(tx *gorm.DB, entries []*LedgerEntry) error {
+	for _, e := range entries {
+		err := tx.Create(e).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to add ledger entry")
+		}
+
+		if e.Referee {
+			result := tx.Model(&User{}).Where("id = ?", e.UserID).
+				Update("reward", gorm.Expr("reward + ?", e.Amount))
+			if result.Error != nil {
+				return errors.WithMessage(result.Error, "Failed to update referee reward")
+			} else if result.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			continue
+		}
+
+		result := tx.Model(&Code{}).Where("code = ?", e.Code).
+			Update("total", gorm.Expr("total + ?", e.Amount))
+		if result.Error != nil {
+			return errors.WithMessage(result.Error, "Failed to update code total")
+		} else if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+	}
+	return nil
+}
+
+func (db *DatabaseImpl) InsertCode(c *Code) error {
+	return db.db.Create(c).Error
+}
+
+func (db *DatabaseImpl) GetCode(code string) (*Code, error) {
+	c := &Code{}
+	err := db.db.Where("code = ?", code).Take(c).Error
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (db *DatabaseImpl) GetOwnedCode(ownerID string) (*Code, error) {
+	c := &Code{}
+	err := db.db.Where("owner_id = ?", ownerID).Order("created_at").Take(c).Error
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (db *DatabaseImpl) UpdateCodeOwner(code, ownerID, payoutAddress string) error {
+	result := db.db.Model(&Code{}).Where("code = ?", code).
+		Updates(map[string]interface{}{
+			"owner_id":       ownerID,
+			"payout_address": payoutAddress,
+		})
+	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (db *DatabaseImpl) SetCodeHeld(code string, held bool) error {
+	return db.db.Model(&Code{}).Where("code = ?", code).Update("held", held).Error
+}
+
+func (db *DatabaseImpl) CountCodeUses(code string, since time.Time) (int64, error) {
+	var count int64
+	err := db.db.Model(&User{}).
+		Where("code = ? and created_at > ?", code, since).
+		Count(&count).Error
+	return count, err
+}
+
+func (db *DatabaseImpl) GetPhoneHash(id *id.ID) ([]byte, error) {
+	var hash []byte
+	err := db.udbDB.Raw("select facts.hash from users inner join facts on users.id = facts.user_id where users.id = ? and facts.type = ?", "\\"+id.HexEncode()[1:], fact.Phone).Row().Scan(&hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, errors.WithMessage(err, "Failed to get phone fact")
+	}
+	return hash, nil
+}
+
+func (db *DatabaseImpl) CheckPhoneHash(phoneHash []byte) (string, error) {
+	u := &User{}
+	err := db.db.Where("phone_hash = ?", phoneHash).Take(u).Error
+	if err != nil {
+		return "", err
+	}
+	return u.ID, nil
+}
+
+func (db *DatabaseImpl) GetUsersWithoutPhoneHash() ([]*User, error) {
+	var users []*User
+	err := db.db.Where("phone_hash is null").Order("created_at").Find(&users).Error
+	return users, err
+}
+
+func (db *DatabaseImpl) SetUserPhoneHash(id string, phoneHash []byte) error {
+	result := db.db.Model(&User{}).Where("id = ?", id).Update("phone_hash", phoneHash)
+	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (db *DatabaseImpl) InsertAttempt(a *Attempt) error {
+	return db.db.Create(a).Error
+}
+
+func (db *DatabaseImpl) CountFailedAttempts(id string, since time.Time) (int64, error) {
+	var count int64
+	err := db.db.Model(&Attempt{}).
+		Where("user_id = ? and result = ? and timestamp > ?", id, AttemptInvalid, since).
+		Count(&count).Error
+	return count, err
+}
+
+func (db *DatabaseImpl) GetAttemptsByResult(result string, since time.Time) ([]*Attempt, error) {
+	var attempts []*Attempt
+	err := db.db.Where("result = ? and timestamp >= ?", result, since).
+		Order("timestamp").Find(&attempts).Error
+	return attempts, err
+}
+
+func (db *DatabaseImpl) GetLockout(id string) (*Lockout, error) {
+	l := &Lockout{}
+	err := db.db.Where("user_id = ?", id).Take(l).Error
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (db *DatabaseImpl) UpsertLockout(l *Lockout) error {
+	return db.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"until"}),
+	}).Create(l).Error
+}
+
+func (db *DatabaseImpl) UpsertBlockedUser(b *BlockedUser) error {
+	return db.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason"}),
+	}).Create(b).Error
+}
+
+func (db *DatabaseImpl) DeleteBlockedUser(id string) error {
+	return db.db.Where("id = ?", id).Delete(&BlockedUser{}).Error
+}
+
+func (db *DatabaseImpl) CheckBlockedUser(id string) (bool, error) {
+	var count int64
+	err := db.db.Model(&BlockedUser{}).Where("id = ?", id).Count(&count).Error
+	return count > 0, err
+}
+
+func (db *DatabaseImpl) GetBlockedUsers() ([]*BlockedUser, error) {
+	var blocked []*BlockedUser
+	err := db.db.Order("created_at").Find(&blocked).Error
+	return blocked, err
+}
+
+func (db *DatabaseImpl) UpsertBlockedCode(b *BlockedCode) error {
+	return db.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "code"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason"}),
+	}).Create(b).Error
+}
+
+func (db *DatabaseImpl) DeleteBlockedCode(code string) error {
+	return db.db.Where("code = ?", code).Delete(&BlockedCode{}).Error
+}
+
+func (db *DatabaseImpl) CheckBlockedCode(code string) (bool, error) {
+	var count int64
+	err := db.db.Model(&BlockedCode{}).Where("code = ?", code).Count(&count).Error
+	return count > 0, err
+}
+
+func (db *DatabaseImpl) GetBlockedCodes() ([]*BlockedCode, error) {
+	var blocked []*BlockedCode
+	err := db.db.Order("created_at").Find(&blocked).Error
+	return blocked, err
+}
+
+func (db *DatabaseImpl) GetPreference(id string) (*Preference, error) {
+	p := &Preference{}
+	err := db.db.Where("user_id = ?", id).Take(p).Error
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (db *DatabaseImpl) UpsertPreference(p *Preference) error {
+	return db.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(p).Error
+}
+
+func (db *DatabaseImpl) InsertMessage(m *Message) error {
+	return db.db.Create(m).Error
+}
+
+func (db *DatabaseImpl) GetQueuedMessages(limit int) ([]*Message, error) {
+	var messages []*Message
+	err := db.db.Where("status = ?", MessageQueued).
+		Order("id").Limit(limit).Find(&messages).Error
+	return messages, err
+}
+
+func (db *DatabaseImpl) GetMessagesByStatus(status string) ([]*Message, error) {
+	var messages []*Message
+	err := db.db.Where("status = ?", status).Order("id").Find(&messages).Error
+	return messages, err
+}
+
+func (db *DatabaseImpl) CountMessages(recipient, kind string, since time.Time) (int64, error) {
+	var count int64
+	err := db.db.Model(&Message{}).
+		Where("recipient = ? and kind = ? and created_at > ?", recipient, kind, since).
+		Count(&count).Error
+	return count, err
+}
+
+func (db *DatabaseImpl) UpdateMessageStatus(id uint64, status string) error {
+	return db.db.Model(&Message{}).Where("id = ?", id).Update("status", status).Error
+}
+
+func (db *DatabaseImpl) QueueDigest(digest *Message, digested []uint64) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(digest).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Message{}).Where("id in ?", digested).
+			Update("status", MessageDigested).Error
+	})
+}
+
+func (db *DatabaseImpl) GetSegment(campaign, status string) ([]string, error) {
+	query := db.db.Model(&User{}).Joins("join codes on codes.code = users.code").
+		Where("users.status not in ?", []string{StatusRejected, StatusReversed})
+	if campaign != "" {
+		query = query.Where("lower(codes.campaign) = lower(?)", campaign)
+	}
+	if status != "" {
+		query = query.Where("users.status = ?", status)
+	}
+	var ids []string
+	err := query.Order("users.created_at").Pluck("users.id", &ids).Error
+	return ids, err
+}
+
+func (db *DatabaseImpl) InsertBroadcast(b *Broadcast, recipients []string) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(b).Error
 		if err != nil {
-			return errors.WithMessage(err, "Failed to use code")
+			return err
+		}
+		if len(recipients) == 0 {
+			return nil
 		}
-		return nil
+		deliveries := make([]*Delivery, len(recipients))
+		for i, uid := range recipients {
+			deliveries[i] = &Delivery{
+				BroadcastID: b.ID,
+				UserID:      uid,
+				Status:      MessageQueued,
+				UpdatedAt:   b.CreatedAt,
+			}
+		}
+		return tx.CreateInBatches(deliveries, 1000).Error
 	})
 }
 
-func (db *DatabaseImpl) CheckRegStatus(id *id.ID) (bool, error) {
-	var count int
-	err := db.udbDB.Raw("select count(*) from users inner join facts on users.id = facts.user_id where users.id = ? and facts.type = ?", "\\"+id.HexEncode()[1:], fact.Phone).Scan(&count).Error
+func (db *DatabaseImpl) GetBroadcast(id uint64) (*Broadcast, error) {
+	b := &Broadcast{}
+	err := db.db.Where("id = ?", id).Take(b).Error
 	if err != nil {
-		return false, errors.WithMessage(err, "Failed to get registration status")
+		return nil, err
+	}
+	return b, nil
+}
+
+func (db *DatabaseImpl) GetBroadcasts() ([]*Broadcast, error) {
+	var broadcasts []*Broadcast
+	err := db.db.Order("id").Find(&broadcasts).Error
+	return broadcasts, err
+}
+
+func (db *DatabaseImpl) UpdateBroadcastState(id uint64, state string) error {
+	result := db.db.Model(&Broadcast{}).Where("id = ?", id).Update("state", state)
+	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (db *DatabaseImpl) GetQueuedDeliveries(limit int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := db.db.Joins("join broadcasts on broadcasts.id = deliveries.broadcast_id").
+		Where("broadcasts.state = ? and deliveries.status = ?", BroadcastActive, MessageQueued).
+		Order("deliveries.broadcast_id").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (db *DatabaseImpl) UpdateDeliveryStatus(broadcastID uint64, userID, status string) error {
+	return db.db.Model(&Delivery{}).
+		Where("broadcast_id = ? and user_id = ?", broadcastID, userID).
+		Updates(map[string]interface{}{"status": status, "updated_at": time.Now()}).Error
+}
+
+func (db *DatabaseImpl) CountDeliveries(broadcastID uint64) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
 	}
-	return count > 0, nil
+	err := db.db.Model(&Delivery{}).Select("status, count(*) as count").
+		Where("broadcast_id = ?", broadcastID).Group("status").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+func (db *DatabaseImpl) CompleteBroadcast(id uint64) (bool, error) {
+	queued := db.db.Model(&Delivery{}).Select("1").
+		Where("broadcast_id = ? and status = ?", id, MessageQueued)
+	result := db.db.Model(&Broadcast{}).
+		Where("id = ? and state = ? and not exists (?)", id, BroadcastActive, queued).
+		Update("state", BroadcastDone)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (db *DatabaseImpl) InsertWelcomeAssignment(w *WelcomeAssignment) error {
+	return db.db.Clauses(clause.OnConflict{DoNothing: true}).Create(w).Error
+}
+
+func (db *DatabaseImpl) GetWelcomeAssignment(id string) (*WelcomeAssignment, error) {
+	w := &WelcomeAssignment{}
+	err := db.db.Where("user_id = ?", id).Take(w).Error
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (db *DatabaseImpl) GetWelcomeStats() ([]*WelcomeStats, error) {
+	var stats []*WelcomeStats
+	err := db.db.Model(&WelcomeAssignment{}).
+		Select("welcome_assignments.campaign, welcome_assignments.variant, " +
+			"count(distinct welcome_assignments.user_id) as assigned, " +
+			"count(distinct attempts.user_id) as submitted, " +
+			"count(distinct users.id) as registered").
+		Joins("left join attempts on attempts.user_id = welcome_assignments.user_id").
+		Joins("left join users on users.id = welcome_assignments.user_id").
+		Group("welcome_assignments.campaign, welcome_assignments.variant").
+		Order("welcome_assignments.campaign, welcome_assignments.variant").
+		Scan(&stats).Error
+	return stats, err
+}
+
+func (db *DatabaseImpl) GetConversation(id string) (*Conversation, error) {
+	c := &Conversation{}
+	err := db.db.Where("user_id = ?", id).Take(c).Error
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (db *DatabaseImpl) UpsertConversation(c *Conversation) error {
+	return db.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(c).Error
+}
+
+func (db *DatabaseImpl) DeleteConversation(id string) error {
+	return db.db.Where("user_id = ?", id).Delete(&Conversation{}).Error
+}
+
+func (db *DatabaseImpl) InsertAdminAction(a *AdminAction) error {
+	return db.db.Create(a).Error
+}
+
+func (db *DatabaseImpl) GetAdminActions(limit int) ([]*AdminAction, error) {
+	var actions []*AdminAction
+	err := db.db.Order("id desc").Limit(limit).Find(&actions).Error
+	return actions, err
 }
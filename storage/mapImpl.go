@@ -7,16 +7,803 @@
 
 package storage
 
-import "gitlab.com/xx_network/primitives/id"
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"time"
+)
 
 func (m *MapImpl) CheckUser(id string) (string, error) {
-	return "", nil
+	m.RLock()
+	defer m.RUnlock()
+	u, ok := m.users[id]
+	if !ok {
+		return "", gorm.ErrRecordNotFound
+	}
+	return u.Code, nil
 }
 
-func (m *MapImpl) UseCode(id, code string) error {
+func (m *MapImpl) UseCode(u *User, entries []*LedgerEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	c, ok := m.coupons[u.Code]
+	if !ok {
+		return ErrInvalidCode
+	}
+	m.users[u.ID] = u
+	err := m.applyEntries(entries)
+	if err != nil {
+		delete(m.users, u.ID)
+		return err
+	}
+	if countsTowardsCode(u.Status) {
+		c.Uses++
+		m.adoptParentCode(u.ID, u.Code)
+	}
+	m.changes = append(m.changes, &StatusChange{
+		UserID:    u.ID,
+		NewStatus: u.Status,
+		Reason:    "registered",
+		CreatedAt: u.CreatedAt,
+	})
 	return nil
 }
 
-func (m *MapImpl) CheckRegStatus(id *id.ID) (bool, error) {
+func (m *MapImpl) GetUser(id string) (*User, error) {
+	m.RLock()
+	defer m.RUnlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return u, nil
+}
+
+func (m *MapImpl) GetUsersByStatus(status string, limit int) ([]*User, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var users []*User
+	for _, u := range m.users {
+		if u.Status == status {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *MapImpl) GetUsersSince(since time.Time) ([]*User, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var users []*User
+	for _, u := range m.users {
+		if !u.CreatedAt.Before(since) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	return users, nil
+}
+
+func (m *MapImpl) UpdateUserStatus(id, oldStatus, newStatus, reason string, entries []*LedgerEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	} else if u.Status != oldStatus {
+		return errors.WithMessagef(ErrInvalidTransition,
+			"registration is %s, not %s", u.Status, oldStatus)
+	}
+	err := m.applyEntries(entries)
+	if err != nil {
+		return err
+	}
+	if c, ok := m.coupons[u.Code]; ok {
+		if countsTowardsCode(newStatus) && !countsTowardsCode(oldStatus) {
+			c.Uses++
+			m.adoptParentCode(id, u.Code)
+		} else if !countsTowardsCode(newStatus) && countsTowardsCode(oldStatus) {
+			c.Uses--
+		}
+	}
+	u.Status = newStatus
+	m.changes = append(m.changes, &StatusChange{
+		UserID:    id,
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+func (m *MapImpl) ChangeUserCode(id, oldCode, newCode, oldStatus, newStatus, reason string, entries []*LedgerEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	} else if u.PreviousCode != "" {
+		return ErrCodeChanged
+	} else if u.Code != oldCode {
+		return errors.Errorf("registration uses code %s, not %s", u.Code, oldCode)
+	} else if u.Status != oldStatus {
+		return errors.WithMessagef(ErrInvalidTransition,
+			"registration is %s, not %s", u.Status, oldStatus)
+	}
+	newC, ok := m.coupons[newCode]
+	if !ok {
+		return ErrInvalidCode
+	}
+	err := m.applyEntries(entries)
+	if err != nil {
+		return err
+	}
+	if oldC, ok := m.coupons[oldCode]; ok && countsTowardsCode(oldStatus) {
+		oldC.Uses--
+	}
+	if countsTowardsCode(newStatus) {
+		newC.Uses++
+	}
+	m.changes = append(m.changes, &StatusChange{
+		UserID:    id,
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+	u.Code = newCode
+	u.PreviousCode = oldCode
+	u.Status = newStatus
+
+	// Codes the user owns follow them to the new code once it counts
+	for _, c := range m.coupons {
+		if c.OwnerID == id && c.ParentCode == oldCode {
+			c.ParentCode = ""
+		}
+	}
+	if countsTowardsCode(newStatus) {
+		m.adoptParentCode(id, newCode)
+	}
+	return nil
+}
+
+func (m *MapImpl) GetStatusChanges(id string) ([]*StatusChange, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var changes []*StatusChange
+	for _, c := range m.changes {
+		if c.UserID == id {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+func (m *MapImpl) GetLedgerEntries(id string) ([]*LedgerEntry, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var entries []*LedgerEntry
+	for _, e := range m.ledger {
+		if e.UserID == id {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MapImpl) AwardMilestone(a *MilestoneAward, entry *LedgerEntry) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	key := MilestoneAward{Code: a.Code, Uses: a.Uses}
+	if m.milestones[key] {
+		return false, nil
+	}
+	err := m.applyEntries([]*LedgerEntry{entry})
+	if err != nil {
+		return false, err
+	}
+	m.milestones[key] = true
 	return true, nil
 }
+
+// adoptParentCode records the code the user registered with as the parent of
+// the codes they own which have none.  The caller must hold the lock.
+func (m *MapImpl) adoptParentCode(ownerID, parent string) {
+	for _, c := range m.coupons {
+		if c.OwnerID == ownerID && c.Code != parent && c.ParentCode == "" {
+			c.ParentCode = parent
+		}
+	}
+}
+
+// applyEntries records ledger entries & adds them to the credited codes' or
+// referees' totals.  The caller must hold the lock.
+func (m *MapImpl) applyEntries(entries []*LedgerEntry) error {
+	for _, e := range entries {
+		if _, ok := m.coupons[e.Code]; !ok {
+			return ErrInvalidCode
+		} else if _, ok = m.users[e.UserID]; e.Referee && !ok {
+			return gorm.ErrRecordNotFound
+		}
+	}
+	for _, e := range entries {
+		if e.Referee {
+			m.users[e.UserID].Reward += e.Amount
+		} else {
+			m.coupons[e.Code].Total += e.Amount
+		}
+		m.ledger = append(m.ledger, e)
+	}
+	return nil
+}
+
+func (m *MapImpl) InsertCode(c *Code) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.coupons[c.Code]; ok {
+		return errors.Errorf("code %s already exists", c.Code)
+	} else if err := m.checkOwner(c.Code, c.OwnerID); err != nil {
+		return err
+	}
+	m.coupons[c.Code] = c
+	return nil
+}
+
+// checkOwner returns an error if a code other than the given one belongs to
+// the owner.  The caller must hold the lock.
+func (m *MapImpl) checkOwner(code, ownerID string) error {
+	if ownerID == "" {
+		return nil
+	}
+	for _, c := range m.coupons {
+		if c.OwnerID == ownerID && c.Code != code {
+			return errors.Errorf("code %s already belongs to %s", c.Code, ownerID)
+		}
+	}
+	return nil
+}
+
+func (m *MapImpl) GetCode(code string) (*Code, error) {
+	m.RLock()
+	defer m.RUnlock()
+	c, ok := m.coupons[code]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return c, nil
+}
+
+func (m *MapImpl) GetOwnedCode(ownerID string) (*Code, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var owned *Code
+	for _, c := range m.coupons {
+		if c.OwnerID == ownerID && (owned == nil || c.CreatedAt.Before(owned.CreatedAt)) {
+			owned = c
+		}
+	}
+	if owned == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return owned, nil
+}
+
+func (m *MapImpl) UpdateCodeOwner(code, ownerID, payoutAddress string) error {
+	m.Lock()
+	defer m.Unlock()
+	c, ok := m.coupons[code]
+	if !ok {
+		return ErrInvalidCode
+	} else if err := m.checkOwner(code, ownerID); err != nil {
+		return err
+	}
+	c.OwnerID = ownerID
+	c.PayoutAddress = payoutAddress
+	return nil
+}
+
+func (m *MapImpl) SetCodeHeld(code string, held bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if c, ok := m.coupons[code]; ok {
+		c.Held = held
+	}
+	return nil
+}
+
+func (m *MapImpl) CountCodeUses(code string, since time.Time) (int64, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var count int64
+	for _, u := range m.users {
+		if u.Code == code && u.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MapImpl) GetPhoneHash(id *id.ID) ([]byte, error) {
+	return id.Bytes(), nil
+}
+
+func (m *MapImpl) CheckPhoneHash(phoneHash []byte) (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, u := range m.users {
+		if bytes.Equal(u.PhoneHash, phoneHash) {
+			return u.ID, nil
+		}
+	}
+	return "", gorm.ErrRecordNotFound
+}
+
+func (m *MapImpl) GetUsersWithoutPhoneHash() ([]*User, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var users []*User
+	for _, u := range m.users {
+		if u.PhoneHash == nil {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	return users, nil
+}
+
+func (m *MapImpl) SetUserPhoneHash(id string, phoneHash []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	u.PhoneHash = phoneHash
+	return nil
+}
+
+func (m *MapImpl) InsertAttempt(a *Attempt) error {
+	m.Lock()
+	defer m.Unlock()
+	m.attempts = append(m.attempts, a)
+	return nil
+}
+
+func (m *MapImpl) CountFailedAttempts(id string, since time.Time) (int64, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var count int64
+	for _, a := range m.attempts {
+		if a.UserID == id && a.Result == AttemptInvalid && a.Timestamp.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MapImpl) GetAttemptsByResult(result string, since time.Time) ([]*Attempt, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var attempts []*Attempt
+	for _, a := range m.attempts {
+		if a.Result == result && !a.Timestamp.Before(since) {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, nil
+}
+
+func (m *MapImpl) GetLockout(id string) (*Lockout, error) {
+	m.RLock()
+	defer m.RUnlock()
+	l, ok := m.lockouts[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return l, nil
+}
+
+func (m *MapImpl) UpsertLockout(l *Lockout) error {
+	m.Lock()
+	defer m.Unlock()
+	m.lockouts[l.UserID] = l
+	return nil
+}
+
+func (m *MapImpl) UpsertBlockedUser(b *BlockedUser) error {
+	m.Lock()
+	defer m.Unlock()
+	m.blockedUsers[b.ID] = b
+	return nil
+}
+
+func (m *MapImpl) DeleteBlockedUser(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.blockedUsers, id)
+	return nil
+}
+
+func (m *MapImpl) CheckBlockedUser(id string) (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.blockedUsers[id]
+	return ok, nil
+}
+
+func (m *MapImpl) GetBlockedUsers() ([]*BlockedUser, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var blocked []*BlockedUser
+	for _, b := range m.blockedUsers {
+		blocked = append(blocked, b)
+	}
+	return blocked, nil
+}
+
+func (m *MapImpl) UpsertBlockedCode(b *BlockedCode) error {
+	m.Lock()
+	defer m.Unlock()
+	m.blockedCodes[b.Code] = b
+	return nil
+}
+
+func (m *MapImpl) DeleteBlockedCode(code string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.blockedCodes, code)
+	return nil
+}
+
+func (m *MapImpl) CheckBlockedCode(code string) (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.blockedCodes[code]
+	return ok, nil
+}
+
+func (m *MapImpl) GetBlockedCodes() ([]*BlockedCode, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var blocked []*BlockedCode
+	for _, b := range m.blockedCodes {
+		blocked = append(blocked, b)
+	}
+	return blocked, nil
+}
+
+func (m *MapImpl) GetPreference(id string) (*Preference, error) {
+	m.RLock()
+	defer m.RUnlock()
+	p, ok := m.preferences[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return p, nil
+}
+
+func (m *MapImpl) UpsertPreference(p *Preference) error {
+	m.Lock()
+	defer m.Unlock()
+	m.preferences[p.UserID] = p
+	return nil
+}
+
+func (m *MapImpl) InsertMessage(msg *Message) error {
+	m.Lock()
+	defer m.Unlock()
+	msg.ID = uint64(len(m.messages) + 1)
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *MapImpl) GetQueuedMessages(limit int) ([]*Message, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var messages []*Message
+	for _, msg := range m.messages {
+		if len(messages) >= limit {
+			break
+		}
+		if msg.Status == MessageQueued {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (m *MapImpl) GetMessagesByStatus(status string) ([]*Message, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var messages []*Message
+	for _, msg := range m.messages {
+		if msg.Status == status {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (m *MapImpl) CountMessages(recipient, kind string, since time.Time) (int64, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var count int64
+	for _, msg := range m.messages {
+		if msg.Recipient == recipient && msg.Kind == kind && msg.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MapImpl) UpdateMessageStatus(id uint64, status string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, msg := range m.messages {
+		if msg.ID == id {
+			msg.Status = status
+		}
+	}
+	return nil
+}
+
+func (m *MapImpl) QueueDigest(digest *Message, digested []uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	ids := make(map[uint64]bool, len(digested))
+	for _, msgID := range digested {
+		ids[msgID] = true
+	}
+	for _, msg := range m.messages {
+		if ids[msg.ID] {
+			msg.Status = MessageDigested
+		}
+	}
+	digest.ID = uint64(len(m.messages) + 1)
+	m.messages = append(m.messages, digest)
+	return nil
+}
+
+func (m *MapImpl) GetSegment(campaign, status string) ([]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var users []*User
+	for _, u := range m.users {
+		if u.Status == StatusRejected || u.Status == StatusReversed {
+			continue
+		} else if status != "" && u.Status != status {
+			continue
+		}
+		if campaign != "" {
+			c, ok := m.coupons[u.Code]
+			if !ok || !strings.EqualFold(c.Campaign, campaign) {
+				continue
+			}
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	return ids, nil
+}
+
+func (m *MapImpl) InsertBroadcast(b *Broadcast, recipients []string) error {
+	m.Lock()
+	defer m.Unlock()
+	b.ID = uint64(len(m.broadcasts) + 1)
+	m.broadcasts = append(m.broadcasts, b)
+	for _, uid := range recipients {
+		m.deliveries = append(m.deliveries, &Delivery{
+			BroadcastID: b.ID,
+			UserID:      uid,
+			Status:      MessageQueued,
+			UpdatedAt:   b.CreatedAt,
+		})
+	}
+	return nil
+}
+
+func (m *MapImpl) GetBroadcast(id uint64) (*Broadcast, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, b := range m.broadcasts {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (m *MapImpl) GetBroadcasts() ([]*Broadcast, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]*Broadcast{}, m.broadcasts...), nil
+}
+
+func (m *MapImpl) UpdateBroadcastState(id uint64, state string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, b := range m.broadcasts {
+		if b.ID == id {
+			b.State = state
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (m *MapImpl) GetQueuedDeliveries(limit int) ([]*Delivery, error) {
+	m.RLock()
+	defer m.RUnlock()
+	active := map[uint64]bool{}
+	for _, b := range m.broadcasts {
+		active[b.ID] = b.State == BroadcastActive
+	}
+	var deliveries []*Delivery
+	for _, d := range m.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		if active[d.BroadcastID] && d.Status == MessageQueued {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MapImpl) UpdateDeliveryStatus(broadcastID uint64, userID, status string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, d := range m.deliveries {
+		if d.BroadcastID == broadcastID && d.UserID == userID {
+			d.Status = status
+			d.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *MapImpl) CountDeliveries(broadcastID uint64) (map[string]int64, error) {
+	m.RLock()
+	defer m.RUnlock()
+	counts := map[string]int64{}
+	for _, d := range m.deliveries {
+		if d.BroadcastID == broadcastID {
+			counts[d.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (m *MapImpl) CompleteBroadcast(id uint64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, d := range m.deliveries {
+		if d.BroadcastID == id && d.Status == MessageQueued {
+			return false, nil
+		}
+	}
+	for _, b := range m.broadcasts {
+		if b.ID == id && b.State == BroadcastActive {
+			b.State = BroadcastDone
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MapImpl) InsertWelcomeAssignment(w *WelcomeAssignment) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.welcomes[w.UserID]; !ok {
+		m.welcomes[w.UserID] = w
+	}
+	return nil
+}
+
+func (m *MapImpl) GetWelcomeAssignment(id string) (*WelcomeAssignment, error) {
+	m.RLock()
+	defer m.RUnlock()
+	w, ok := m.welcomes[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return w, nil
+}
+
+func (m *MapImpl) GetWelcomeStats() ([]*WelcomeStats, error) {
+	m.RLock()
+	defer m.RUnlock()
+	submitted := map[string]bool{}
+	for _, a := range m.attempts {
+		submitted[a.UserID] = true
+	}
+
+	byVariant := map[[2]string]*WelcomeStats{}
+	var stats []*WelcomeStats
+	for _, w := range m.welcomes {
+		key := [2]string{w.Campaign, w.Variant}
+		ws, ok := byVariant[key]
+		if !ok {
+			ws = &WelcomeStats{Campaign: w.Campaign, Variant: w.Variant}
+			byVariant[key] = ws
+			stats = append(stats, ws)
+		}
+		ws.Assigned++
+		if submitted[w.UserID] {
+			ws.Submitted++
+		}
+		if _, ok := m.users[w.UserID]; ok {
+			ws.Registered++
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Campaign != stats[j].Campaign {
+			return stats[i].Campaign < stats[j].Campaign
+		}
+		return stats[i].Variant < stats[j].Variant
+	})
+	return stats, nil
+}
+
+func (m *MapImpl) GetConversation(id string) (*Conversation, error) {
+	m.RLock()
+	defer m.RUnlock()
+	c, ok := m.conversations[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return c, nil
+}
+
+func (m *MapImpl) UpsertConversation(c *Conversation) error {
+	m.Lock()
+	defer m.Unlock()
+	m.conversations[c.UserID] = c
+	return nil
+}
+
+func (m *MapImpl) DeleteConversation(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.conversations, id)
+	return nil
+}
+
+func (m *MapImpl) InsertAdminAction(a *AdminAction) error {
+	m.Lock()
+	defer m.Unlock()
+	a.ID = uint64(len(m.adminActions) + 1)
+	m.adminActions = append(m.adminActions, a)
+	return nil
+}
+
+func (m *MapImpl) GetAdminActions(limit int) ([]*AdminAction, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var actions []*AdminAction
+	for i := len(m.adminActions) - 1; i >= 0 && len(actions) < limit; i-- {
+		actions = append(actions, m.adminActions[i])
+	}
+	return actions, nil
+}
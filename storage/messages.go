@@ -0,0 +1,68 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles queueing of bot-initiated messages, which are delivered by the bot
+// process so they may be created from anywhere with access to storage
+
+package storage
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// Kinds of queued messages
+const (
+	MessageAlert = "alert"
+	// Notices about a user's own registration
+	MessageNotice = "notice"
+	// Notices to code owners about registrations using their codes
+	MessageReferral = "referral"
+	// Congratulations to code owners on reaching a milestone
+	MessageMilestone = "milestone"
+)
+
+// Delivery states of queued messages
+const (
+	MessageQueued = "queued"
+	MessageSent   = "sent"
+	MessageFailed = "failed"
+	// Held to be batched into a digest
+	MessageDigest = "digest"
+	// Delivered as part of a digest
+	MessageDigested = "digested"
+	// Not delivered as the recipient opted out
+	MessageSkipped = "skipped"
+)
+
+// QueueAlert queues a message to be delivered to all bot admins
+func (s *Storage) QueueAlert(text string) {
+	jww.WARN.Printf("Alert: %s", text)
+	err := s.InsertMessage(&Message{
+		Kind:      MessageAlert,
+		Text:      text,
+		Status:    MessageQueued,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to queue alert %q: %+v", text, err)
+	}
+}
+
+// QueueMessage queues a message to be delivered to a user
+func (s *Storage) QueueMessage(uid, kind, text string) {
+	err := s.InsertMessage(&Message{
+		Kind:      kind,
+		Recipient: uid,
+		Text:      text,
+		Status:    MessageQueued,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to queue %s message to %s: %+v", kind, uid, err)
+	}
+}
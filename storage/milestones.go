@@ -0,0 +1,65 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles crediting bonuses to codes reaching milestone numbers of uses
+
+package storage
+
+import (
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// MilestoneRule credits a bonus to a code once it reaches a number of
+// approved uses.  Deprecated in favour of milestone actions in the rules.
+type MilestoneRule struct {
+	Uses  int
+	Bonus int
+}
+
+// awardMilestones credits the bonus of every milestone reached by the code
+// which was not already awarded, congratulating the owner on each.  Milestone
+// bonuses are not tied to a registration, so are kept if one is reversed.
+func (s *Storage) awardMilestones(code string, milestones []rules.Milestone) {
+	if len(milestones) == 0 {
+		return
+	}
+	c, err := s.GetCode(code)
+	if err != nil {
+		jww.ERROR.Printf("Failed to get code %s: %+v", code, err)
+		return
+	}
+
+	for _, m := range milestones {
+		now := time.Now()
+		awarded, err := s.AwardMilestone(&MilestoneAward{
+			Code:      code,
+			Uses:      m.Uses,
+			CreatedAt: now,
+		}, &LedgerEntry{
+			Code:      code,
+			Amount:    m.Bonus,
+			Kind:      LedgerMilestone,
+			CreatedAt: now,
+		})
+		if err != nil {
+			jww.ERROR.Printf("Failed to award milestone of %d uses to code %s: %+v",
+				m.Uses, code, err)
+			continue
+		} else if !awarded {
+			continue
+		}
+
+		jww.INFO.Printf("Code %s reached %d uses, crediting bonus of %d", code, m.Uses, m.Bonus)
+		if c.OwnerID != "" && s.notifications(c.OwnerID) != NotifyNone {
+			s.QueueMessage(c.OwnerID, MessageMilestone, s.Text(c.OwnerID, "notice.milestone",
+				catalog.Data{"Code": code, "Uses": m.Uses, "Bonus": m.Bonus}))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"testing"
+)
+
+// Rules crediting the referrer & a bonus once the code reaches 2 uses
+const testMilestoneRules = `
+rules:
+  - name: referral
+    then:
+      - type: credit
+        amount: 10
+      - type: milestone
+        uses: 2
+        amount: 50
+`
+
+// Tests that milestone bonuses are credited once, are kept when a
+// registration is reversed, & are not credited again when the milestone is
+// reached a second time
+func TestStorage_awardMilestones(t *testing.T) {
+	s := newTestStorage(t, testMilestoneRules, Config{})
+	owner := createOwnedCode(t, s, "CODE", NotifyAll)
+
+	registerTestUser(t, s, "a", "CODE")
+	checkCode(t, s, "CODE", 1, 10)
+	registerTestUser(t, s, "b", "CODE")
+	checkCode(t, s, "CODE", 2, 70)
+	c := registerTestUser(t, s, "c", "CODE")
+	checkCode(t, s, "CODE", 3, 80)
+
+	err := s.ReverseRegistration(c.String(), "fraud", false)
+	if err != nil {
+		t.Fatalf("Failed to reverse registration: %+v", err)
+	}
+	checkCode(t, s, "CODE", 2, 70)
+	registerTestUser(t, s, "d", "CODE")
+	checkCode(t, s, "CODE", 3, 80)
+
+	var congratulated int
+	for _, m := range messagesTo(t, s, owner, MessageQueued) {
+		if m.Kind == MessageMilestone {
+			congratulated++
+		}
+	}
+	if congratulated != 1 {
+		t.Errorf("Owner was congratulated %d times, expected once", congratulated)
+	}
+}
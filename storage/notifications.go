@@ -0,0 +1,136 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles notifying code owners of registrations using their codes
+
+package storage
+
+import (
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"strings"
+	"time"
+)
+
+// Notification settings
+const (
+	NotifyAll    = "all"
+	NotifyDigest = "digest"
+	NotifyNone   = "none"
+)
+
+// DigestParams configures when notices to code owners are batched into
+// digests rather than sent individually.  A Threshold of zero only batches
+// notices for users who asked for digests.
+type DigestParams struct {
+	// Number of notices a user may be sent within Window before further
+	// notices are batched
+	Threshold int
+	Window    time.Duration
+}
+
+// notifyReferrer queues a notice to the owner of the code about an approved
+// registration using it, holding it for a digest if the owner asked for
+// digests or has been sent many notices recently
+func (s *Storage) notifyReferrer(code string) {
+	c, err := s.GetCode(code)
+	if err != nil {
+		jww.ERROR.Printf("Failed to get code %s: %+v", code, err)
+		return
+	} else if c.OwnerID == "" {
+		return
+	}
+
+	setting := s.notifications(c.OwnerID)
+	if setting == NotifyNone {
+		return
+	}
+
+	status := MessageQueued
+	if setting == NotifyDigest {
+		status = MessageDigest
+	} else if dp := s.config.Digest; dp.Threshold > 0 {
+		sent, err := s.CountMessages(c.OwnerID, MessageReferral, time.Now().Add(-dp.Window))
+		if err != nil {
+			jww.ERROR.Printf("Failed to count notices sent to %s: %+v", c.OwnerID, err)
+		} else if sent >= int64(dp.Threshold) {
+			status = MessageDigest
+		}
+	}
+
+	err = s.InsertMessage(&Message{
+		Kind:      MessageReferral,
+		Recipient: c.OwnerID,
+		Code:      code,
+		Text: s.Text(c.OwnerID, "notice.referral",
+			catalog.Data{"Code": code, "Uses": c.Uses}),
+		Status:    status,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to queue notice to %s: %+v", c.OwnerID, err)
+	}
+}
+
+// FlushDigests combines the notices held for digests into a single message
+// per user & queues it for delivery.  Each user's digest is queued in the
+// same operation that marks their notices digested, so no notice is sent twice.
+func (s *Storage) FlushDigests() error {
+	held, err := s.GetMessagesByStatus(MessageDigest)
+	if err != nil {
+		return err
+	}
+
+	// Count the held notices per code for each user
+	type codeCount struct {
+		code  string
+		count int
+	}
+	counts := make(map[string][]*codeCount)
+	ids := make(map[string][]uint64)
+	var recipients []string
+	for _, m := range held {
+		if _, ok := counts[m.Recipient]; !ok {
+			recipients = append(recipients, m.Recipient)
+		}
+		ids[m.Recipient] = append(ids[m.Recipient], m.ID)
+		var cc *codeCount
+		for _, existing := range counts[m.Recipient] {
+			if existing.code == m.Code {
+				cc = existing
+			}
+		}
+		if cc == nil {
+			cc = &codeCount{code: m.Code}
+			counts[m.Recipient] = append(counts[m.Recipient], cc)
+		}
+		cc.count++
+	}
+
+	for _, recipient := range recipients {
+		var lines []string
+		for _, cc := range counts[recipient] {
+			data := catalog.Data{"Count": cc.count, "Code": cc.code}
+			if c, err := s.GetCode(cc.code); err == nil {
+				data["Uses"] = c.Uses
+			}
+			lines = append(lines, s.Text(recipient, "notice.digest", data))
+		}
+		err = s.QueueDigest(&Message{
+			Kind:      MessageReferral,
+			Recipient: recipient,
+			Text:      strings.Join(lines, "\n"),
+			Status:    MessageQueued,
+			CreatedAt: time.Now(),
+		}, ids[recipient])
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to queue digest to %s", recipient)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+)
+
+// digestErrorDB is a map backend failing to queue digests to one recipient
+type digestErrorDB struct {
+	*MapImpl
+	failed string
+}
+
+func (db *digestErrorDB) QueueDigest(digest *Message, digested []uint64) error {
+	if digest.Recipient == db.failed {
+		return errors.New("database unavailable")
+	}
+	return db.MapImpl.QueueDigest(digest, digested)
+}
+
+// createOwnedCode adds a code owned by a new user with the notification
+// setting, returning the owner
+func createOwnedCode(t *testing.T, s *Storage, code, setting string) *id.ID {
+	t.Helper()
+	owner := id.NewIdFromString(code+" owner", id.User, t)
+	err := s.CreateCode(code, "", owner.String(), "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create code %s: %+v", code, err)
+	}
+	err = s.SetNotifications(owner.String(), setting)
+	if err != nil {
+		t.Fatalf("Failed to set notifications: %+v", err)
+	}
+	return owner
+}
+
+// messagesTo returns the messages to the recipient with the status
+func messagesTo(t *testing.T, s *Storage, recipient *id.ID, status string) []*Message {
+	t.Helper()
+	messages, err := s.GetMessagesByStatus(status)
+	if err != nil {
+		t.Fatalf("Failed to get messages: %+v", err)
+	}
+	var to []*Message
+	for _, m := range messages {
+		if m.Recipient == recipient.String() {
+			to = append(to, m)
+		}
+	}
+	return to
+}
+
+// Tests that code owners are notified of each approved registration unless
+// they asked for digests or no notices
+func TestStorage_notifyReferrer(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	all := createOwnedCode(t, s, "ALL", NotifyAll)
+	digest := createOwnedCode(t, s, "DIGEST", NotifyDigest)
+	none := createOwnedCode(t, s, "NONE", NotifyNone)
+
+	registerTestUser(t, s, "a", "ALL")
+	registerTestUser(t, s, "b", "DIGEST")
+	registerTestUser(t, s, "c", "NONE")
+
+	if n := len(messagesTo(t, s, all, MessageQueued)); n != 1 {
+		t.Errorf("Expected 1 notice queued to the owner of ALL, got %d", n)
+	}
+	if n := len(messagesTo(t, s, digest, MessageDigest)); n != 1 {
+		t.Errorf("Expected 1 notice held for the owner of DIGEST, got %d", n)
+	}
+	if n := len(messagesTo(t, s, digest, MessageQueued)); n != 0 {
+		t.Errorf("Expected no notice queued to the owner of DIGEST, got %d", n)
+	}
+	if n := len(messagesTo(t, s, none, MessageQueued)); n != 0 {
+		t.Errorf("Expected no notice queued to the owner of NONE, got %d", n)
+	}
+}
+
+// Tests that a digest is queued once for the notices held for each owner,
+// even if queueing another owner's digest fails
+func TestStorage_FlushDigests(t *testing.T) {
+	s := newTestStorage(t, "", Config{})
+	first := createOwnedCode(t, s, "FIRST", NotifyDigest)
+	second := createOwnedCode(t, s, "SECOND", NotifyDigest)
+	registerTestUser(t, s, "a", "FIRST")
+	registerTestUser(t, s, "b", "FIRST")
+	registerTestUser(t, s, "c", "SECOND")
+
+	db := &digestErrorDB{MapImpl: s.database.(*MapImpl), failed: second.String()}
+	s.database = db
+	if err := s.FlushDigests(); err == nil {
+		t.Fatal("Expected an error queueing the digest")
+	}
+	if n := len(messagesTo(t, s, first, MessageQueued)); n != 1 {
+		t.Fatalf("Expected 1 digest queued to the owner of FIRST, got %d", n)
+	}
+	if n := len(messagesTo(t, s, first, MessageDigested)); n != 2 {
+		t.Errorf("Expected 2 notices digested for the owner of FIRST, got %d", n)
+	}
+	if n := len(messagesTo(t, s, second, MessageDigest)); n != 1 {
+		t.Errorf("Expected the notice for the owner of SECOND to still be held, got %d", n)
+	}
+
+	db.failed = ""
+	if err := s.FlushDigests(); err != nil {
+		t.Fatalf("Failed to flush digests: %+v", err)
+	}
+	if n := len(messagesTo(t, s, first, MessageQueued)); n != 1 {
+		t.Errorf("Owner of FIRST was queued %d digests, expected 1", n)
+	}
+	if n := len(messagesTo(t, s, second, MessageQueued)); n != 1 {
+		t.Errorf("Owner of SECOND was queued %d digests, expected 1", n)
+	}
+	if n := len(messagesTo(t, s, second, MessageDigest)); n != 0 {
+		t.Errorf("%d notices are still held for the owner of SECOND", n)
+	}
+}
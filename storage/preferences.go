@@ -0,0 +1,98 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles users' preferences for messages initiated by the bot
+
+package storage
+
+import (
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// GetPreferences returns the user's preferences, or the defaults if they
+// have not set any
+func (s *Storage) GetPreferences(uid string) (*Preference, error) {
+	p, err := s.GetPreference(uid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &Preference{UserID: uid, Notifications: NotifyAll}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetNotifications sets which messages the user is sent by the bot other
+// than replies: all, digests of referral notices only, or none
+func (s *Storage) SetNotifications(uid, setting string) error {
+	switch setting {
+	case NotifyAll, NotifyDigest, NotifyNone:
+	default:
+		return errors.Errorf("unknown notification setting %q", setting)
+	}
+	return s.updatePreferences(uid, func(p *Preference) {
+		p.Notifications = setting
+	})
+}
+
+// SetLanguage sets the language of the messages the user is sent by the bot.
+// An empty language resets it to the default.
+func (s *Storage) SetLanguage(uid, language string) error {
+	language = strings.ToLower(language)
+	if language != "" && !s.config.Catalog.Has(language) {
+		return errors.Errorf("unsupported language %q, choose from %s", language,
+			strings.Join(s.config.Catalog.Locales(), ", "))
+	}
+	return s.updatePreferences(uid, func(p *Preference) {
+		p.Language = language
+	})
+}
+
+// Text returns the named text rendered in the user's language
+func (s *Storage) Text(uid, name string, data catalog.Data) string {
+	language := ""
+	if p, err := s.GetPreference(uid); err == nil {
+		language = p.Language
+	}
+	return s.config.Catalog.Render(language, name, data)
+}
+
+// OptedOut returns whether the user has asked not to receive messages
+// initiated by the bot.  Every outbound path other than direct replies must
+// check it.
+func (s *Storage) OptedOut(uid string) bool {
+	return s.notifications(uid) == NotifyNone
+}
+
+// notifications returns the user's notification setting, defaulting to all
+func (s *Storage) notifications(uid string) string {
+	p, err := s.GetPreference(uid)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			jww.ERROR.Printf("Failed to get preferences of %s: %+v", uid, err)
+		}
+		return NotifyAll
+	}
+	return p.Notifications
+}
+
+// updatePreferences applies the update to the user's preferences, keeping
+// the settings it does not change
+func (s *Storage) updatePreferences(uid string, update func(p *Preference)) error {
+	p, err := s.GetPreferences(uid)
+	if err != nil {
+		return err
+	}
+	updated := *p
+	update(&updated)
+	updated.UpdatedAt = time.Now()
+	return s.UpsertPreference(&updated)
+}
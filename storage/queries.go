@@ -0,0 +1,45 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles read-only queries about users' incentive state
+
+package storage
+
+import (
+	"time"
+)
+
+// RegistrationStatus is a user's registration with incentives
+type RegistrationStatus struct {
+	Code     string
+	Campaign string
+	// One of StatusPending, StatusApproved, StatusRejected, StatusReversed
+	// or StatusPaid
+	Status    string
+	CreatedAt time.Time
+	// Total rewards credited to the user for registering
+	Reward int
+}
+
+// GetRegistrationStatus returns the registration of the user.  Returns
+// gorm.ErrRecordNotFound if the user has not registered.
+func (s *Storage) GetRegistrationStatus(uid string) (*RegistrationStatus, error) {
+	u, err := s.GetUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	rs := &RegistrationStatus{
+		Code:      u.Code,
+		Status:    u.Status,
+		CreatedAt: u.CreatedAt,
+		Reward:    u.Reward,
+	}
+	if c, err := s.GetCode(u.Code); err == nil {
+		rs.Campaign = c.Campaign
+	}
+	return rs, nil
+}
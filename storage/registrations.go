@@ -0,0 +1,317 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the lifecycle of registrations after a code has been used
+
+package storage
+
+import (
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"sort"
+	"time"
+)
+
+// Registration states
+const (
+	// Held for review; not credited to the code until approved
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	StatusReversed = "reversed"
+	StatusPaid     = "paid"
+)
+
+// Kinds of ledger entries
+const (
+	LedgerReferral  = "referral"
+	LedgerReferee   = "referee"
+	LedgerReversal  = "reversal"
+	LedgerMilestone = "milestone"
+)
+
+// Maximum number of codes up the referral chain which may be credited
+const maxReferralDepth = 10
+
+// Reward credited to the code for each registration before rewards were
+// recorded in the ledger
+const legacyReferralReward = 10
+
+// ErrInvalidTransition is returned when a registration cannot move to the
+// requested state from its current one
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// transitions lists the states each registration state may move to
+var transitions = map[string][]string{
+	StatusPending:  {StatusApproved, StatusRejected},
+	StatusApproved: {StatusPaid, StatusReversed},
+	StatusPaid:     {StatusReversed},
+}
+
+// countsTowardsCode returns whether registrations in the state are included
+// in their code's uses & total
+func countsTowardsCode(status string) bool {
+	return status == StatusApproved || status == StatusPaid
+}
+
+// evaluate applies the reward rules to a registration using the code made at
+// the given time
+func (s *Storage) evaluate(c *Code, registered time.Time) rules.Outcome {
+	return s.config.Rules.Evaluate(rules.Registration{
+		Code:     c.Code,
+		Campaign: c.Campaign,
+		Tags:     c.TagList(),
+		Uses:     c.Uses + 1,
+		Time:     registered,
+	})
+}
+
+// LegacyRules translates the deprecated reward settings of the campaigns into
+// rules crediting the same rewards, followed by the default rules for codes
+// of other campaigns.  Returns nil if no campaign has reward settings.
+func LegacyRules(campaigns map[string]Campaign) *rules.RuleSet {
+	names := make([]string, 0, len(campaigns))
+	for name := range campaigns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rs := &rules.RuleSet{}
+	for _, name := range names {
+		c := campaigns[name]
+		if len(c.Tiers) == 0 && len(c.Milestones) == 0 && c.RefereeReward == 0 {
+			continue
+		}
+		rule := rules.Rule{
+			Name:  "campaign " + name,
+			When:  rules.Conditions{Campaigns: []string{name}},
+			Final: true,
+		}
+		if len(c.Tiers) == 0 {
+			rule.Then = append(rule.Then, rules.Default().Rules[0].Then...)
+		}
+		for tier, amount := range c.Tiers {
+			if tier >= maxReferralDepth {
+				break
+			} else if amount == 0 {
+				continue
+			}
+			a := rules.Action{Type: rules.ActionCredit, To: rules.ToReferrer, Amount: amount}
+			if tier > 0 {
+				a.To, a.Tier = rules.ToUpline, tier
+			}
+			rule.Then = append(rule.Then, a)
+		}
+		if c.RefereeReward != 0 {
+			rule.Then = append(rule.Then, rules.Action{
+				Type:   rules.ActionCredit,
+				To:     rules.ToReferee,
+				Amount: c.RefereeReward,
+			})
+		}
+		for _, m := range c.Milestones {
+			if m.Uses > 0 {
+				rule.Then = append(rule.Then, rules.Action{
+					Type:   rules.ActionMilestone,
+					Uses:   m.Uses,
+					Amount: m.Bonus,
+				})
+			}
+		}
+		rs.Rules = append(rs.Rules, rule)
+	}
+	if len(rs.Rules) == 0 {
+		return nil
+	}
+	rs.Rules = append(rs.Rules, rules.Default().Rules...)
+	return rs
+}
+
+// rewardEntries returns the ledger entries for the credits of an approved
+// registration.  Credits to the upline go to the code the given number of
+// steps up the referral chain, which is the chain of codes each code owner
+// registered with.
+func (s *Storage) rewardEntries(uid, code string, o rules.Outcome) []*LedgerEntry {
+	var entries []*LedgerEntry
+	for _, credit := range o.Credits {
+		if credit.Amount == 0 {
+			continue
+		}
+		e := &LedgerEntry{
+			UserID:    uid,
+			Code:      code,
+			Amount:    credit.Amount,
+			Kind:      LedgerReferral,
+			CreatedAt: time.Now(),
+		}
+		switch credit.To {
+		case rules.ToReferee:
+			e.Referee = true
+			e.Kind = LedgerReferee
+		case rules.ToUpline:
+			e.Code = s.uplineCode(code, credit.Tier)
+			e.Tier = credit.Tier
+			if e.Code == "" {
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// uplineCode returns the code the given number of steps up the referral chain
+// from the code, or an empty string if the chain is shorter or loops
+func (s *Storage) uplineCode(code string, tier int) string {
+	if tier > maxReferralDepth {
+		return ""
+	}
+	visited := map[string]bool{code: true}
+	for i := 0; i < tier; i++ {
+		c, err := s.GetCode(code)
+		if err != nil {
+			jww.ERROR.Printf("Failed to get code %s: %+v", code, err)
+			return ""
+		}
+		code = c.ParentCode
+		if code == "" {
+			return ""
+		} else if visited[code] {
+			jww.WARN.Printf("Referral chain loops back to code %s", code)
+			return ""
+		}
+		visited[code] = true
+	}
+	return code
+}
+
+// codeUsed runs the follow up actions for an approved registration using the code
+func (s *Storage) codeUsed(code string, o rules.Outcome) {
+	s.notifyReferrer(code)
+	s.awardMilestones(code, o.Milestones)
+}
+
+// GetReviewQueue returns up to limit registrations awaiting review, oldest first
+func (s *Storage) GetReviewQueue(limit int) ([]*User, error) {
+	return s.GetUsersByStatus(StatusPending, limit)
+}
+
+// ApproveRegistration approves a pending registration, crediting its code
+func (s *Storage) ApproveRegistration(uid, reason string) error {
+	u, err := s.GetUser(uid)
+	if err != nil {
+		return err
+	}
+	c, err := s.GetCode(u.Code)
+	if err != nil {
+		return err
+	}
+
+	// Holds & rejections from the rules are overridden by the approval.  Date
+	// conditions apply to when the user registered, not when they were reviewed.
+	o := s.evaluate(c, u.CreatedAt)
+	err = s.transition(u, StatusApproved, reason, s.rewardEntries(uid, u.Code, o))
+	if err != nil {
+		return err
+	}
+	s.codeUsed(u.Code, o)
+	return nil
+}
+
+// RejectRegistration rejects a pending registration
+func (s *Storage) RejectRegistration(uid, reason string) error {
+	u, err := s.GetUser(uid)
+	if err != nil {
+		return err
+	}
+	return s.transition(u, StatusRejected, reason, nil)
+}
+
+// MarkPaid records that the rewards for an approved registration were paid out
+func (s *Storage) MarkPaid(uid, reason string) error {
+	u, err := s.GetUser(uid)
+	if err != nil {
+		return err
+	}
+	return s.transition(u, StatusPaid, reason, nil)
+}
+
+// ReverseRegistration reverses an approved or paid registration, debiting
+// every reward credited for it in the same operation.  If notify is set, the
+// user is sent a message including the reason.
+func (s *Storage) ReverseRegistration(uid, reason string, notify bool) error {
+	u, err := s.GetUser(uid)
+	if err != nil {
+		return err
+	}
+	corrections, err := s.reversalEntries(uid)
+	if err != nil {
+		return err
+	}
+
+	err = s.transition(u, StatusReversed, reason, corrections)
+	if err != nil {
+		return err
+	}
+
+	if notify {
+		s.QueueMessage(uid, MessageNotice, s.Text(uid, "notice.reversed",
+			catalog.Data{"Code": u.Code, "Reason": reason}))
+	}
+	return nil
+}
+
+// reversalEntries returns the ledger entries debiting every reward still
+// credited for the registration
+func (s *Storage) reversalEntries(uid string) ([]*LedgerEntry, error) {
+	// Net out the rewards credited to each code & the user for the registration
+	entries, err := s.GetLedgerEntries(uid)
+	if err != nil {
+		return nil, err
+	}
+	type beneficiary struct {
+		code    string
+		referee bool
+	}
+	net := make(map[beneficiary]int)
+	var beneficiaries []beneficiary
+	for _, e := range entries {
+		b := beneficiary{e.Code, e.Referee}
+		if _, ok := net[b]; !ok {
+			beneficiaries = append(beneficiaries, b)
+		}
+		net[b] += e.Amount
+	}
+	var corrections []*LedgerEntry
+	for _, b := range beneficiaries {
+		if net[b] == 0 {
+			continue
+		}
+		corrections = append(corrections, &LedgerEntry{
+			UserID:    uid,
+			Code:      b.code,
+			Amount:    -net[b],
+			Referee:   b.referee,
+			Kind:      LedgerReversal,
+			CreatedAt: time.Now(),
+		})
+	}
+	return corrections, nil
+}
+
+// transition moves the registration to a new state if allowed, applying the
+// ledger entries in the same operation
+func (s *Storage) transition(u *User, status, reason string, entries []*LedgerEntry) error {
+	for _, allowed := range transitions[u.Status] {
+		if allowed == status {
+			return s.UpdateUserStatus(u.ID, u.Status, status, reason, entries)
+		}
+	}
+	return errors.WithMessagef(ErrInvalidTransition, "cannot move from %s to %s", u.Status, status)
+}
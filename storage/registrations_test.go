@@ -0,0 +1,231 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+	"time"
+)
+
+// Rules crediting the referrer, the referee & the code one step up the chain
+const testRules = `
+rules:
+  - name: referral
+    then:
+      - type: credit
+        amount: 10
+      - type: credit
+        to: referee
+        amount: 5
+      - type: credit
+        to: upline
+        tier: 1
+        amount: 3
+`
+
+// checkLedgerNets fails the test unless the ledger entries for the
+// registration sum to zero for every code & the user
+func checkLedgerNets(t *testing.T, s *Storage, uid *id.ID) {
+	t.Helper()
+	entries, err := s.GetLedgerEntries(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get ledger entries: %+v", err)
+	}
+	net := map[string]int{}
+	for _, e := range entries {
+		key := e.Code
+		if e.Referee {
+			key = "referee"
+		}
+		net[key] += e.Amount
+	}
+	for key, amount := range net {
+		if amount != 0 {
+			t.Errorf("Ledger for %s nets to %d, expected 0", key, amount)
+		}
+	}
+}
+
+// Tests that reversing a registration debits every reward credited for it,
+// including credits up the referral chain, & leaves other credits alone
+func TestStorage_ReverseRegistration(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{})
+	createTestCode(t, s, "ROOT")
+
+	// A registers with ROOT, then refers B with their own code
+	a := registerTestUser(t, s, "a", "ROOT")
+	s.IssueCode(a)
+	owned, err := s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to issue code to a: %+v", err)
+	}
+	b := registerTestUser(t, s, "b", owned.Code)
+	checkCode(t, s, owned.Code, 1, 10)
+	checkCode(t, s, "ROOT", 1, 13)
+
+	err = s.ReverseRegistration(b.String(), "fraud", false)
+	if err != nil {
+		t.Fatalf("Failed to reverse registration: %+v", err)
+	}
+
+	u, err := s.GetUser(b.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if u.Status != StatusReversed {
+		t.Errorf("Registration is %s, expected %s", u.Status, StatusReversed)
+	}
+	if u.Reward != 0 {
+		t.Errorf("Referee reward is %d after reversal, expected 0", u.Reward)
+	}
+	checkCode(t, s, owned.Code, 0, 0)
+	checkCode(t, s, "ROOT", 1, 10)
+	checkLedgerNets(t, s, b)
+
+	// Reversals are final
+	err = s.ReverseRegistration(b.String(), "again", false)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected %v reversing twice, got %v", ErrInvalidTransition, err)
+	}
+	checkCode(t, s, owned.Code, 0, 0)
+}
+
+// Tests that registrations pending review, which were never credited, cannot
+// be reversed
+func TestStorage_ReverseRegistration_Pending(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{})
+	createTestCode(t, s, "HELD")
+	err := s.HoldCode("HELD")
+	if err != nil {
+		t.Fatalf("Failed to hold code: %+v", err)
+	}
+	uid := registerTestUser(t, s, "a", "HELD")
+
+	err = s.ReverseRegistration(uid.String(), "fraud", false)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected %v reversing a pending registration, got %v", ErrInvalidTransition, err)
+	}
+	checkCode(t, s, "HELD", 0, 0)
+}
+
+// Tests that a registration approved after review is credited, and that
+// reversing it debits exactly what the approval credited
+func TestStorage_ReverseRegistration_Approved(t *testing.T) {
+	s := newTestStorage(t, testRules, Config{})
+	createTestCode(t, s, "HELD")
+	err := s.HoldCode("HELD")
+	if err != nil {
+		t.Fatalf("Failed to hold code: %+v", err)
+	}
+	uid := registerTestUser(t, s, "a", "HELD")
+
+	err = s.ApproveRegistration(uid.String(), "checked")
+	if err != nil {
+		t.Fatalf("Failed to approve registration: %+v", err)
+	}
+	checkCode(t, s, "HELD", 1, 10)
+
+	err = s.ReverseRegistration(uid.String(), "fraud", false)
+	if err != nil {
+		t.Fatalf("Failed to reverse registration: %+v", err)
+	}
+	checkCode(t, s, "HELD", 0, 0)
+	checkLedgerNets(t, s, uid)
+}
+
+// Tests that approving a held registration applies the rules as of when the
+// user registered, so rewards of a campaign which has since ended are kept
+func TestStorage_ApproveRegistration_RegistrationTime(t *testing.T) {
+	s := newTestStorage(t, `
+rules:
+  - name: summer promotion
+    when:
+      after: 2022-06-01
+      before: 2022-09-01
+    then:
+      - type: credit
+        amount: 20
+`, Config{})
+	createTestCode(t, s, "HELD")
+	err := s.HoldCode("HELD")
+	if err != nil {
+		t.Fatalf("Failed to hold code: %+v", err)
+	}
+	uid := registerTestUser(t, s, "a", "HELD")
+
+	// The map backend returns the stored registration, so this backdates it
+	u, err := s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	u.CreatedAt = time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	err = s.ApproveRegistration(uid.String(), "checked")
+	if err != nil {
+		t.Fatalf("Failed to approve registration: %+v", err)
+	}
+	checkCode(t, s, "HELD", 1, 20)
+}
+
+// Tests that the deprecated reward settings of campaigns are translated into
+// rules crediting the same rewards, & that other codes get the default reward
+func TestLegacyRules(t *testing.T) {
+	if rs := LegacyRules(map[string]Campaign{"plain": {AutoIssueCode: true}}); rs != nil {
+		t.Errorf("Expected no rules for campaigns without reward settings, got %+v", rs)
+	}
+
+	campaigns := map[string]Campaign{"launch": {
+		Tiers:         []int{20, 5},
+		Milestones:    []MilestoneRule{{Uses: 2, Bonus: 50}},
+		RefereeReward: 3,
+	}}
+	engine, err := rules.NewStaticEngine(LegacyRules(campaigns))
+	if err != nil {
+		t.Fatalf("Failed to create engine: %+v", err)
+	}
+	s := newTestStorage(t, "", Config{Campaigns: campaigns, Rules: engine})
+	for code, campaign := range map[string]string{"ROOT": "Launch", "OTHER": ""} {
+		err = s.CreateCode(code, campaign, "", "", nil)
+		if err != nil {
+			t.Fatalf("Failed to create code %s: %+v", code, err)
+		}
+	}
+
+	a := registerTestUser(t, s, "a", "ROOT")
+	checkCode(t, s, "ROOT", 1, 20)
+	entries, err := s.GetLedgerEntries(a.String())
+	if err != nil {
+		t.Fatalf("Failed to get ledger entries: %+v", err)
+	}
+	var referee int
+	for _, e := range entries {
+		if e.Referee {
+			referee += e.Amount
+		}
+	}
+	if referee != 3 {
+		t.Errorf("Referee was credited %d, expected 3", referee)
+	}
+
+	s.IssueCode(a)
+	owned, err := s.GetOwnedCode(a.String())
+	if err != nil {
+		t.Fatalf("Failed to issue code to a: %+v", err)
+	}
+	registerTestUser(t, s, "b", owned.Code)
+	checkCode(t, s, owned.Code, 1, 20)
+	checkCode(t, s, "ROOT", 1, 25)
+
+	registerTestUser(t, s, "c", "ROOT")
+	checkCode(t, s, "ROOT", 2, 95)
+	registerTestUser(t, s, "d", "OTHER")
+	checkCode(t, s, "OTHER", 1, 10)
+}
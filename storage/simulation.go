@@ -0,0 +1,179 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles replaying past registrations through alternative reward rules
+
+package storage
+
+import (
+	"fmt"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"sort"
+	"time"
+)
+
+// Simulation compares the rewards two rule sets would have credited for the
+// same registrations
+type Simulation struct {
+	// Registrations & rule rejected attempts replayed
+	Registrations int
+	Current       Payout
+	Proposed      Payout
+}
+
+// Payout is the result of replaying registrations through a rule set
+type Payout struct {
+	// Rewards credited to each code, including milestone bonuses
+	Codes map[string]int
+	// Rewards credited to the registering users
+	Referees int
+	// Registrations the rules held for review or rejected, which earn nothing
+	Held     int
+	Rejected int
+}
+
+// Total returns the sum of all rewards in the payout
+func (p Payout) Total() int {
+	total := p.Referees
+	for _, amount := range p.Codes {
+		total += amount
+	}
+	return total
+}
+
+// replayed is a registration, or an attempt rejected by the rules, replayed
+// in a simulation
+type replayed struct {
+	code string
+	time time.Time
+}
+
+// SimulateRules replays the registrations made since the given time, along
+// with the last attempt rejected by the rules of each user who has not since
+// registered, through the current & proposed rule sets.  Registrations
+// rejected or reversed by an admin are left out.
+// Holds from code reviews & velocity checks are not simulated.
+func (s *Storage) SimulateRules(current, proposed *rules.RuleSet, since time.Time) (*Simulation, error) {
+	users, err := s.GetUsersSince(since)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get registrations")
+	}
+	attempts, err := s.GetAttemptsByResult(AttemptRejected, since)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get rejected attempts")
+	}
+
+	// Uses of each code made before the replayed registrations
+	codes := map[string]*Code{}
+	base := map[string]int{}
+	var events []replayed
+	add := func(code string, t time.Time) {
+		if _, ok := codes[code]; !ok {
+			c, err := s.GetCode(code)
+			if err != nil {
+				jww.WARN.Printf("Skipping registration with code %s: %+v", code, err)
+				return
+			}
+			codes[code] = c
+			base[code] = c.Uses
+		}
+		events = append(events, replayed{code: code, time: t})
+	}
+	registered := map[string]bool{}
+	for _, u := range users {
+		registered[u.ID] = true
+		if u.Status == StatusRejected || u.Status == StatusReversed {
+			continue
+		}
+		add(u.Code, u.CreatedAt)
+		if _, ok := codes[u.Code]; ok && countsTowardsCode(u.Status) {
+			base[u.Code]--
+		}
+	}
+
+	// Users may retry after a rejection, so only the latest attempt of each
+	// user who never registered is replayed
+	latest := map[string]*Attempt{}
+	for _, a := range attempts {
+		if registered[a.UserID] {
+			continue
+		}
+		if l, ok := latest[a.UserID]; !ok || a.Timestamp.After(l.Timestamp) {
+			latest[a.UserID] = a
+		}
+	}
+	for _, a := range latest {
+		add(a.Code, a.Timestamp)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time.Before(events[j].time)
+	})
+
+	return &Simulation{
+		Registrations: len(events),
+		Current:       s.replay(current, events, codes, base),
+		Proposed:      s.replay(proposed, events, codes, base),
+	}, nil
+}
+
+// replay evaluates each registration in order against the rule set, counting
+// the uses of each code from its uses before the first registration
+func (s *Storage) replay(rs *rules.RuleSet, events []replayed, codes map[string]*Code,
+	base map[string]int) Payout {
+	p := Payout{Codes: map[string]int{}}
+	uses := map[string]int{}
+	for code, n := range base {
+		uses[code] = n
+	}
+	awarded := map[string]bool{}
+
+	for _, e := range events {
+		c := codes[e.code]
+		o := rs.Evaluate(rules.Registration{
+			Code:     c.Code,
+			Campaign: c.Campaign,
+			Tags:     c.TagList(),
+			Uses:     uses[e.code] + 1,
+			Time:     e.time,
+		})
+		if o.Reject {
+			p.Rejected++
+			continue
+		} else if o.Hold {
+			p.Held++
+			continue
+		}
+		uses[e.code]++
+
+		for _, credit := range o.Credits {
+			switch credit.To {
+			case rules.ToReferee:
+				p.Referees += credit.Amount
+			case rules.ToUpline:
+				if upline := s.uplineCode(e.code, credit.Tier); upline != "" {
+					p.Codes[upline] += credit.Amount
+				}
+			default:
+				p.Codes[e.code] += credit.Amount
+			}
+		}
+
+		// Milestones reached before the replayed registrations were already
+		// awarded under the rules in place at the time
+		for _, m := range o.Milestones {
+			key := fmt.Sprintf("%s/%d", e.code, m.Uses)
+			if m.Uses <= base[e.code] || awarded[key] {
+				continue
+			}
+			awarded[key] = true
+			p.Codes[e.code] += m.Bonus
+		}
+	}
+	return p
+}
@@ -0,0 +1,56 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+	"time"
+)
+
+// Rules rejecting every registration
+const testRejectRules = `
+rules:
+  - name: closed
+    then:
+      - type: reject
+        message: registrations are closed
+`
+
+// Tests that users rejected by the rules are replayed once, whether or not
+// they retried & registered later
+func TestStorage_SimulateRules(t *testing.T) {
+	s := newTestStorage(t, testRejectRules, Config{})
+	createTestCode(t, s, "CODE")
+	a := id.NewIdFromString("a", id.User, t)
+	b := id.NewIdFromString("b", id.User, t)
+	for i := 0; i < 2; i++ {
+		s.Register(a, "CODE")
+		s.Register(b, "CODE")
+	}
+	checkNotRegistered(t, s, a)
+
+	var err error
+	s.config.Rules, err = rules.NewEngine("")
+	if err != nil {
+		t.Fatalf("Failed to create engine: %+v", err)
+	}
+	registerTestUser(t, s, "a", "CODE")
+
+	sim, err := s.SimulateRules(rules.Default(), rules.Default(), time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to simulate rules: %+v", err)
+	}
+	if sim.Registrations != 2 {
+		t.Errorf("Replayed %d registrations, expected 2", sim.Registrations)
+	}
+	if total := sim.Proposed.Codes["CODE"]; total != 20 {
+		t.Errorf("Proposed rules credit CODE %d, expected 20", total)
+	}
+}
@@ -11,12 +11,40 @@
 package storage
 
 import (
-	"errors"
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"git.xx.network/elixxir/incentives-bot/catalog"
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/xx_network/primitives/id"
 	"gorm.io/gorm"
+	"strings"
+	"time"
 )
 
+// Results recorded for each code submission
+const (
+	AttemptSuccess = "success"
+	AttemptInvalid = "invalid"
+	AttemptFailed  = "failed"
+	// Rejected as the phone number was used by another identity
+	AttemptSybil = "sybil"
+	// Rejected as the code is on the blocklist
+	AttemptBlocked = "blocked"
+	// Rejected as the user owns the code
+	AttemptSelfReferral = "self_referral"
+	// Rejected by the reward rules
+	AttemptRejected = "rejected"
+)
+
+// ErrInvalidCode is returned when a submitted code does not exist
+var ErrInvalidCode = errors.New("code does not exist")
+
+// ErrCodeChanged is returned when a user tries to change their code again
+var ErrCodeChanged = errors.New("code has already been changed")
+
 // Params for creating a storage object
 type Params struct {
 	Username string
@@ -26,54 +54,421 @@ type Params struct {
 	Port     string
 }
 
+// Config holds the business rules applied by the storage layer
+type Config struct {
+	Lockout  LockoutParams
+	Velocity VelocityParams
+	// Only issue personal codes to users with an approved registration
+	OwnCodeRequiresRegistration bool
+	// Settings of each campaign by lowercase name
+	Campaigns map[string]Campaign
+	Digest    DigestParams
+	// Determines the rewards credited for registrations & whether they are
+	// held or rejected
+	Rules *rules.Engine
+	// Texts sent to users in each language
+	Catalog *catalog.Catalog
+	// Messages sent once an authenticated channel is confirmed
+	Welcome WelcomeFlow
+	// Campaign whose welcome flow, if it has one, is used instead
+	WelcomeCampaign string
+	// Time after registering during which users may change their code once;
+	// zero disables changes
+	CodeChangeWindow time.Duration
+	// Fail rather than fall back to the map backend, whose changes are lost
+	// when the process exits, if the database is unavailable
+	RequireDatabase bool
+}
+
+// Campaign holds the settings applied to the codes of a campaign
+type Campaign struct {
+	// Issue users a personal code when they register with one of the
+	// campaign's codes
+	AutoIssueCode bool
+	// Deprecated reward settings from before the rules engine, translated
+	// into rules by LegacyRules when no rules file is configured.
+	// Rewards credited for each approved registration, starting with the
+	// used code & continuing up the chain of codes its owner registered with
+	Tiers []int
+	// Bonuses credited to codes reaching a number of approved uses
+	Milestones []MilestoneRule
+	// Reward credited to users registering with one of the campaign's codes
+	RefereeReward int
+	// Description of how rewards are paid, included in the reply to users
+	// registering with one of the campaign's codes
+	PayoutInfo string
+	// Replaces the default welcome flow while this is the welcome campaign
+	Welcome *WelcomeFlow
+}
+
+// LockoutParams configures the lockout applied to users who repeatedly
+// submit invalid codes.  A MaxAttempts of zero disables the lockout.
+type LockoutParams struct {
+	// Number of invalid codes allowed within Window before locking out
+	MaxAttempts int
+	Window      time.Duration
+	// How long a user is locked out for
+	Duration time.Duration
+}
+
+// VelocityParams configures the registration rates at which a code is held
+// for review.  A limit of zero disables the corresponding check.
+type VelocityParams struct {
+	MaxPerHour int
+	MaxPerDay  int
+}
+
 // Storage struct interfaces with the API for the storage layer
 type Storage struct {
 	// Stored Database interface
 	database
+	config Config
 }
 
 // NewStorage creates a new Storage object wrapping a database interface
 // Returns a Storage object, and error
-func NewStorage(params Params, udbParams Params) (*Storage, error) {
-	db, err := newDatabase(params, udbParams)
-	storage := &Storage{db}
+func NewStorage(params Params, udbParams Params, config Config) (*Storage, error) {
+	db, err := newDatabase(params, udbParams, config.RequireDatabase)
+	if config.Rules == nil {
+		config.Rules, _ = rules.NewEngine("")
+	}
+	if config.Catalog == nil {
+		config.Catalog = catalog.Default()
+	}
+	storage := &Storage{database: db, config: config}
 	return storage, err
 }
 
-// Register a user with the incentives bot.  Returns a response string
-func (s *Storage) Register(uid *id.ID, code string) string {
-	var strResponse string
+// candidate is a code which passed the checks made before it is used
+type candidate struct {
+	code      *Code
+	phoneHash []byte
+	outcome   rules.Outcome
+}
+
+// checkCode runs the checks made before a user registers with a code,
+// recording any refused attempt.  Returns the code to register with, or the
+// response refusing it.
+func (s *Storage) checkCode(uid *id.ID, code string) (*candidate, string) {
+	// Refuse any submissions while the user is locked out
+	if until, locked := s.lockedOut(uid); locked {
+		return nil, s.Text(uid.String(), "register.lockedOut", catalog.Data{"Until": formatTime(until)})
+	}
+
 	// Check if user has registered already
 	usedCode, err := s.CheckUser(uid.String())
+	if err == nil {
+		// Registered already with incentives
+		return nil, s.Text(uid.String(), "register.already", catalog.Data{"Code": usedCode})
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		// Received unexpected error
+		return nil, s.Text(uid.String(), "register.checkError", catalog.Data{"Error": err})
+	}
+
+	// Check registration status with UDB
+	phoneHash, err := s.GetPhoneHash(uid)
 	if err != nil {
-		// If err is recordNotFound continue
+		// Failed to check UDB registration status
+		return nil, s.Text(uid.String(), "register.udbError", catalog.Data{"Code": code, "Error": err})
+	} else if phoneHash == nil {
+		// User has not registered a phone number with UDB
+		return nil, s.Text(uid.String(), "register.noPhone", catalog.Data{"Code": code})
+	}
+
+	// Reject users whose phone number was already counted for another identity
+	otherID, err := s.CheckPhoneHash(phoneHash)
+	if err == nil {
+		jww.WARN.Printf("Flagged %s registering with code %s: phone already registered by %s", uid, code, otherID)
+		s.recordAttempt(uid, code, AttemptSybil)
+		return nil, s.Text(uid.String(), "register.sybil", catalog.Data{"Code": code})
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, s.Text(uid.String(), "register.phoneError", catalog.Data{"Code": code, "Error": err})
+	}
+
+	// Blocked codes get a reply which does not reveal the block
+	if blocked, err := s.isCodeBlocked(code); err != nil {
+		return nil, s.Text(uid.String(), "register.checkError", catalog.Data{"Error": err})
+	} else if blocked {
+		jww.INFO.Printf("User %s attempted to use blocked code %s", uid, code)
+		s.recordAttempt(uid, code, AttemptBlocked)
+		return nil, s.Text(uid.String(), "register.refused", catalog.Data{"Code": code})
+	}
+
+	c, err := s.GetCode(code)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, s.invalidCode(uid, code)
+	} else if err != nil {
+		return nil, s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	}
+
+	// Users may not redeem codes they own
+	if self, err := s.isSelfReferral(uid, phoneHash, c); err != nil {
+		return nil, s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	} else if self {
+		jww.WARN.Printf("Flagged %s attempting to use their own code %s", uid, code)
+		s.recordAttempt(uid, code, AttemptSelfReferral)
+		return nil, s.Text(uid.String(), "register.selfReferral", catalog.Data{"Code": code})
+	}
+
+	// Registrations refused by the rules are not recorded
+	o := s.evaluate(c, time.Now())
+	if o.Reject {
+		jww.INFO.Printf("Rules %v rejected %s registering with code %s", o.Fired, uid, code)
+		s.recordAttempt(uid, code, AttemptRejected)
+		return nil, s.Text(uid.String(), "register.refused", catalog.Data{"Code": code, "Reason": o.Message})
+	}
+
+	return &candidate{code: c, phoneHash: phoneHash, outcome: o}, ""
+}
+
+// PreviewCode checks that the user could register with the code, without
+// using it.  Returns the prompt asking the user to confirm the code and true,
+// or the response refusing it and false.
+func (s *Storage) PreviewCode(uid *id.ID, code string) (string, bool) {
+	cand, refusal := s.checkCode(uid, code)
+	if cand == nil {
+		return refusal, false
+	}
+	return s.Text(uid.String(), "confirm.prompt",
+		catalog.Data{"Code": code, "Campaign": cand.code.Campaign}), true
+}
+
+// Register a user with the incentives bot.  Returns a response string
+func (s *Storage) Register(uid *id.ID, code string) string {
+	cand, refusal := s.checkCode(uid, code)
+	if cand == nil {
+		return refusal
+	}
+	c, phoneHash, o := cand.code, cand.phoneHash, cand.outcome
+
+	// Registrations on codes with suspicious usage are held for review
+	status := StatusApproved
+	if c.Held || o.Hold || s.checkVelocity(code) {
+		status = StatusPending
+	}
+
+	// Attempt to use the code sent
+	var entries []*LedgerEntry
+	if status == StatusApproved {
+		entries = s.rewardEntries(uid.String(), code, o)
+	}
+	err := s.UseCode(&User{
+		ID:        uid.String(),
+		Code:      code,
+		PhoneHash: phoneHash,
+		Status:    status,
+		CreatedAt: time.Now(),
+	}, entries)
+	if errors.Is(err, ErrInvalidCode) {
+		return s.invalidCode(uid, code)
+	} else if err != nil {
+		// Failed to use the code
+		s.recordAttempt(uid, code, AttemptFailed)
+		return s.Text(uid.String(), "register.error", catalog.Data{"Code": code, "Error": err})
+	}
+
+	// Successfully registered with incentives
+	s.recordAttempt(uid, code, AttemptSuccess)
+	campaign := s.campaign(c.Campaign)
+	data := catalog.Data{"Code": code, "Reward": o.Total(rules.ToReferee)}
+	if status == StatusPending {
+		if o.Hold {
+			data["Reason"] = o.Message
+		}
+		return s.Text(uid.String(), "register.pending", data)
+	}
+	s.codeUsed(code, o)
+	data["PayoutInfo"] = campaign.PayoutInfo
+
+	// Give the user a code of their own to continue the referral chain
+	if campaign.AutoIssueCode {
+		owned, err := s.GetOwnedCode(uid.String())
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			// Check registration status with UDB
-			registered, err := s.CheckRegStatus(uid)
+			owned, err = s.issueCode(uid.String(), code, c.Campaign)
+		}
+		if err != nil {
+			jww.ERROR.Printf("Failed to issue code to %s: %+v", uid, err)
+		} else {
+			data["OwnCode"] = owned.Code
+		}
+	}
+	return s.Text(uid.String(), "register.success", data)
+}
+
+// WatchRules reloads the reward rules when their file changes until stop is
+// closed
+func (s *Storage) WatchRules(interval time.Duration, stop chan struct{}) {
+	s.config.Rules.Watch(interval, stop)
+}
+
+// campaign returns the settings of the named campaign.  Campaign names are
+// case-insensitive.
+func (s *Storage) campaign(name string) Campaign {
+	return s.config.Campaigns[strings.ToLower(name)]
+}
+
+// BackfillPhoneHashes records the UD phone fact hash of registrations made
+// before phone numbers were tracked, so the numbers behind them are counted
+// by the check rejecting numbers reused by another identity.  Registrations
+// whose number is already counted for another identity are left without one.
+// Returns the number of registrations updated.
+func (s *Storage) BackfillPhoneHashes() (int, error) {
+	users, err := s.GetUsersWithoutPhoneHash()
+	if err != nil {
+		return 0, err
+	}
+	filled := 0
+	for _, u := range users {
+		uid, err := ParseUserID(u.ID)
+		if err != nil {
+			jww.ERROR.Printf("Registration has invalid user ID %s: %+v", u.ID, err)
+			continue
+		}
+		phoneHash, err := s.GetPhoneHash(uid)
+		if err != nil {
+			return filled, err
+		} else if phoneHash == nil {
+			continue
+		}
+
+		otherID, err := s.CheckPhoneHash(phoneHash)
+		if err == nil {
+			jww.WARN.Printf("Phone of %s is already registered by %s", uid, otherID)
+			continue
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return filled, err
+		}
+
+		err = s.SetUserPhoneHash(u.ID, phoneHash)
+		if err != nil {
+			return filled, err
+		}
+		filled++
+	}
+	return filled, nil
+}
+
+// invalidCode records a submission of a code which does not exist, locking
+// the user out if they keep guessing.  Returns the response string.
+func (s *Storage) invalidCode(uid *id.ID, code string) string {
+	s.recordAttempt(uid, code, AttemptInvalid)
+	data := catalog.Data{"Code": code}
+	if until, locked := s.lockedOut(uid); locked {
+		data["Until"] = formatTime(until)
+	}
+	return s.Text(uid.String(), "register.invalid", data)
+}
+
+// isSelfReferral returns whether the user owns the code, either directly or
+// by sharing the owner's UD phone fact.  Callers must refuse the code if
+// ownership cannot be checked.
+func (s *Storage) isSelfReferral(uid *id.ID, phoneHash []byte, c *Code) (bool, error) {
+	if c.OwnerID == "" {
+		return false, nil
+	} else if c.OwnerID == uid.String() {
+		return true, nil
+	}
+
+	owner, err := ParseUserID(c.OwnerID)
+	if err != nil {
+		return false, errors.WithMessagef(err, "code has invalid owner %s", c.OwnerID)
+	}
+	ownerHash, err := s.GetPhoneHash(owner)
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to check the code's owner")
+	}
+	return ownerHash != nil && bytes.Equal(ownerHash, phoneHash), nil
+}
+
+// recordAttempt stores the outcome of a code submission, locking the user out
+// if it pushes them over the allowed number of invalid attempts
+func (s *Storage) recordAttempt(uid *id.ID, code, result string) {
+	now := time.Now()
+	err := s.InsertAttempt(&Attempt{
+		UserID:    uid.String(),
+		Code:      code,
+		Result:    result,
+		Timestamp: now,
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to record attempt by %s: %+v", uid, err)
+	}
+
+	lp := s.config.Lockout
+	if result != AttemptInvalid || lp.MaxAttempts <= 0 {
+		return
+	}
+	failed, err := s.CountFailedAttempts(uid.String(), now.Add(-lp.Window))
+	if err != nil {
+		jww.ERROR.Printf("Failed to count failed attempts by %s: %+v", uid, err)
+		return
+	}
+	if failed >= int64(lp.MaxAttempts) {
+		jww.WARN.Printf("Locking out %s after %d invalid codes", uid, failed)
+		err = s.UpsertLockout(&Lockout{UserID: uid.String(), Until: now.Add(lp.Duration)})
+		if err != nil {
+			jww.ERROR.Printf("Failed to lock out %s: %+v", uid, err)
+		}
+	}
+}
+
+// checkVelocity determines whether another registration would push the code
+// over the configured rate limits.  If so, the code is held for review and
+// admins are alerted.
+func (s *Storage) checkVelocity(code string) bool {
+	now := time.Now()
+	limits := []struct {
+		window time.Duration
+		name   string
+		max    int
+	}{
+		{time.Hour, "hour", s.config.Velocity.MaxPerHour},
+		{24 * time.Hour, "day", s.config.Velocity.MaxPerDay},
+	}
+	for _, limit := range limits {
+		if limit.max <= 0 {
+			continue
+		}
+		uses, err := s.CountCodeUses(code, now.Add(-limit.window))
+		if err != nil {
+			jww.ERROR.Printf("Failed to count uses of code %s: %+v", code, err)
+			continue
+		}
+		if uses+1 > int64(limit.max) {
+			err = s.SetCodeHeld(code, true)
 			if err != nil {
-				// Failed to check UDB registration status
-				strResponse = fmt.Sprintf("Could not use code %s (failed to check udb registration status): %+v", code, err)
-			} else if !registered {
-				// User has not registered a phone number with UDB
-				strResponse = fmt.Sprintf("Could not use code %s (must have registered a phone number with UD)", code)
-			} else {
-				// Attempt to use the code sent
-				err = s.UseCode(uid.String(), code)
-				if err != nil {
-					// Failed to use the code
-					strResponse = fmt.Sprintf("Could not use code %s: %s", code, err.Error())
-				} else {
-					// Successfully registered with incentives
-					strResponse = fmt.Sprintf("Thank you for using the xx messenger!  Your referral code %s has been registered.", code)
-				}
+				jww.ERROR.Printf("Failed to hold code %s: %+v", code, err)
 			}
-		} else {
-			// Received unexpected error
-			strResponse = fmt.Sprintf("Could not check user in database: %+v", err)
+			s.QueueAlert(fmt.Sprintf("Code %s has been held for review: %d registrations "+
+				"in the last %s exceeds the limit of %d", code, uses+1, limit.name, limit.max))
+			return true
 		}
-	} else {
-		// Registered already with incentives
-		strResponse = fmt.Sprintf("User has already registered with incentives using code %s", usedCode)
 	}
-	return strResponse
+	return false
+}
+
+// lockedOut returns the end of the user's lockout and whether it is in effect
+func (s *Storage) lockedOut(uid *id.ID) (time.Time, bool) {
+	l, err := s.GetLockout(uid.String())
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			jww.ERROR.Printf("Failed to check lockout for %s: %+v", uid, err)
+		}
+		return time.Time{}, false
+	}
+	return l.Until, l.Until.After(time.Now())
+}
+
+// formatTime formats a time for display to users
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// ParseUserID decodes a user ID from the base64 format stored in the database
+func ParseUserID(s string) (*id.ID, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return id.Unmarshal(data)
 }
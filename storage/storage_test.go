@@ -7,6 +7,16 @@
 
 package storage
 
+import (
+	"git.xx.network/elixxir/incentives-bot/rules"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
 //func TestStorage(t *testing.T) {
 //	db, err := NewStorage(Params{
 //		Username: "jonahhusson",
@@ -38,3 +48,255 @@ package storage
 //	strResponse := db.Register(uid, "test")
 //	t.Error(strResponse)
 //}
+
+// phoneDB is a map backend in which users may share a UD phone fact, or have
+// one which cannot be looked up
+type phoneDB struct {
+	*MapImpl
+	phones map[string][]byte
+	failed map[string]bool
+}
+
+func (db *phoneDB) GetPhoneHash(uid *id.ID) ([]byte, error) {
+	if db.failed[uid.String()] {
+		return nil, errors.New("UDB unavailable")
+	} else if hash, ok := db.phones[uid.String()]; ok {
+		return hash, nil
+	}
+	return db.MapImpl.GetPhoneHash(uid)
+}
+
+// newTestStorage returns a storage object backed by a map, evaluating the
+// YAML rules if any are given
+func newTestStorage(t *testing.T, rulesYAML string, config Config) *Storage {
+	t.Helper()
+	if rulesYAML != "" {
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		err := ioutil.WriteFile(path, []byte(rulesYAML), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write rules: %+v", err)
+		}
+		config.Rules, err = rules.NewEngine(path)
+		if err != nil {
+			t.Fatalf("Failed to load rules: %+v", err)
+		}
+	}
+	s, err := NewStorage(Params{}, Params{}, config)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	return s
+}
+
+// newPhoneStorage returns a storage object backed by a map in which the
+// phone facts of users may be set
+func newPhoneStorage(t *testing.T, config Config) (*Storage, *phoneDB) {
+	t.Helper()
+	s := newTestStorage(t, "", config)
+	db := &phoneDB{
+		MapImpl: s.database.(*MapImpl),
+		phones:  map[string][]byte{},
+		failed:  map[string]bool{},
+	}
+	s.database = db
+	return s, db
+}
+
+// createTestCode adds a code to the storage
+func createTestCode(t *testing.T, s *Storage, code string) {
+	t.Helper()
+	err := s.CreateCode(code, "", "", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create code %s: %+v", code, err)
+	}
+}
+
+// registerTestUser registers a new user with the code, failing the test
+// unless the registration is stored
+func registerTestUser(t *testing.T, s *Storage, name, code string) *id.ID {
+	t.Helper()
+	uid := id.NewIdFromString(name, id.User, t)
+	s.Register(uid, code)
+	u, err := s.GetUser(uid.String())
+	if err != nil {
+		t.Fatalf("%s was not registered with code %s: %+v", name, code, err)
+	}
+	if u.Code != code {
+		t.Fatalf("%s registered with code %s, not %s", name, u.Code, code)
+	}
+	return uid
+}
+
+// checkCode fails the test unless the code has the uses & total
+func checkCode(t *testing.T, s *Storage, code string, uses, total int) {
+	t.Helper()
+	c, err := s.GetCode(code)
+	if err != nil {
+		t.Fatalf("Failed to get code %s: %+v", code, err)
+	}
+	if c.Uses != uses || c.Total != total {
+		t.Errorf("Code %s has %d uses & total %d, expected %d uses & total %d",
+			code, c.Uses, c.Total, uses, total)
+	}
+}
+
+// checkNotRegistered fails the test if the user is registered
+func checkNotRegistered(t *testing.T, s *Storage, uid *id.ID) {
+	t.Helper()
+	if u, err := s.GetUser(uid.String()); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("User was registered: %+v, %v", u, err)
+	}
+}
+
+// Tests that a phone number counted for one identity cannot be used to
+// register another
+func TestStorage_Register_Sybil(t *testing.T) {
+	s, db := newPhoneStorage(t, Config{})
+	createTestCode(t, s, "CODE")
+	a := id.NewIdFromString("a", id.User, t)
+	b := id.NewIdFromString("b", id.User, t)
+	db.phones[a.String()] = []byte("phone")
+	db.phones[b.String()] = []byte("phone")
+
+	registerTestUser(t, s, "a", "CODE")
+	strResponse := s.Register(b, "CODE")
+	expected := "Could not use code CODE (this phone number has already been used to register with incentives)"
+	if strResponse != expected {
+		t.Errorf("Expected response %q, got %q", expected, strResponse)
+	}
+	checkNotRegistered(t, s, b)
+	checkCode(t, s, "CODE", 1, 10)
+
+	var attempts []*Attempt
+	for _, a := range db.attempts {
+		if a.Result == AttemptSybil {
+			attempts = append(attempts, a)
+		}
+	}
+	if len(attempts) != 1 || attempts[0].UserID != b.String() {
+		t.Errorf("Expected one sybil attempt by b, got %+v", attempts)
+	}
+}
+
+// Tests that registrations made before phone numbers were tracked have them
+// backfilled, unless the number is already counted for another identity
+func TestStorage_BackfillPhoneHashes(t *testing.T) {
+	s, db := newPhoneStorage(t, Config{})
+	createTestCode(t, s, "CODE")
+	a := id.NewIdFromString("a", id.User, t)
+	b := id.NewIdFromString("b", id.User, t)
+	c := id.NewIdFromString("c", id.User, t)
+	db.phones[b.String()] = []byte("phone")
+	db.phones[c.String()] = []byte("phone")
+	for _, uid := range []*id.ID{a, b, c} {
+		db.users[uid.String()] = &User{ID: uid.String(), Code: "CODE"}
+	}
+	db.users[c.String()].PhoneHash = []byte("phone")
+
+	filled, err := s.BackfillPhoneHashes()
+	if err != nil {
+		t.Fatalf("Failed to backfill phone hashes: %+v", err)
+	}
+	if filled != 1 || db.users[a.String()].PhoneHash == nil {
+		t.Errorf("Expected the phone hash of a to be backfilled, filled %d", filled)
+	}
+	if db.users[b.String()].PhoneHash != nil {
+		t.Error("Phone hash counted for c was backfilled for b")
+	}
+}
+
+// Tests that users cannot register with their own code, or a code owned by
+// an identity sharing their phone number
+func TestStorage_Register_SelfReferral(t *testing.T) {
+	s, db := newPhoneStorage(t, Config{})
+	owner := id.NewIdFromString("owner", id.User, t)
+	alias := id.NewIdFromString("alias", id.User, t)
+	db.phones[owner.String()] = []byte("phone")
+	db.phones[alias.String()] = []byte("phone")
+	err := s.CreateCode("OWN", "", owner.String(), "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create code: %+v", err)
+	}
+
+	for _, uid := range []*id.ID{owner, alias} {
+		strResponse := s.Register(uid, "OWN")
+		expected := "Could not use code OWN (you cannot use your own referral code)"
+		if strResponse != expected {
+			t.Errorf("Expected response %q, got %q", expected, strResponse)
+		}
+		checkNotRegistered(t, s, uid)
+	}
+	checkCode(t, s, "OWN", 0, 0)
+
+	var attempts int
+	for _, a := range db.attempts {
+		if a.Result == AttemptSelfReferral {
+			attempts++
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 self referral attempts, got %d", attempts)
+	}
+
+	registerTestUser(t, s, "other", "OWN")
+}
+
+// Tests that registrations are refused if the code's owner cannot be checked
+func TestStorage_Register_SelfReferralError(t *testing.T) {
+	s, db := newPhoneStorage(t, Config{})
+	owner := id.NewIdFromString("owner", id.User, t)
+	db.failed[owner.String()] = true
+	err := s.CreateCode("OWN", "", owner.String(), "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create code: %+v", err)
+	}
+
+	uid := id.NewIdFromString("user", id.User, t)
+	s.Register(uid, "OWN")
+	checkNotRegistered(t, s, uid)
+	checkCode(t, s, "OWN", 0, 0)
+}
+
+// Tests that registrations exceeding the velocity limit hold the code for
+// review & alert admins, while earlier registrations are credited
+func TestStorage_Register_Velocity(t *testing.T) {
+	s := newTestStorage(t, "", Config{Velocity: VelocityParams{MaxPerHour: 2}})
+	createTestCode(t, s, "CODE")
+
+	registerTestUser(t, s, "a", "CODE")
+	registerTestUser(t, s, "b", "CODE")
+	c := registerTestUser(t, s, "c", "CODE")
+	d := registerTestUser(t, s, "d", "CODE")
+	checkCode(t, s, "CODE", 2, 20)
+
+	for _, uid := range []*id.ID{c, d} {
+		u, err := s.GetUser(uid.String())
+		if err != nil {
+			t.Fatalf("Failed to get user: %+v", err)
+		}
+		if u.Status != StatusPending {
+			t.Errorf("Registration over the limit is %s, expected %s", u.Status, StatusPending)
+		}
+	}
+	code, err := s.GetCode("CODE")
+	if err != nil {
+		t.Fatalf("Failed to get code: %+v", err)
+	}
+	if !code.Held {
+		t.Error("Code exceeding the limit was not held")
+	}
+
+	messages, err := s.GetQueuedMessages(10)
+	if err != nil {
+		t.Fatalf("Failed to get queued messages: %+v", err)
+	}
+	var alerts int
+	for _, m := range messages {
+		if m.Kind == MessageAlert {
+			alerts++
+		}
+	}
+	if alerts != 1 {
+		t.Errorf("Expected 1 alert, got %d", alerts)
+	}
+}
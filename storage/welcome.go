@@ -0,0 +1,153 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the messages sent to users once their authenticated channel to the
+// bot is confirmed
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Delay before the welcome when none is configured, giving the confirmation
+// time to reach the user
+const defaultWelcomeDelay = 100 * time.Millisecond
+
+// WelcomeFlow configures the welcome sent to new users.  Each user is
+// assigned one of the variants, weighted by their Weight, which is recorded
+// so the variants can be compared.
+type WelcomeFlow struct {
+	// Delay between confirming the channel & sending the welcome
+	Delay    time.Duration
+	Variants []WelcomeVariant
+}
+
+// WelcomeVariant is one version of the welcome
+type WelcomeVariant struct {
+	Name string
+	// Relative share of users assigned this variant; defaults to 1
+	Weight int
+	// Names of the catalog texts sent in order: the welcome, then any tips
+	Texts []string
+	// Delay before each tip
+	TipDelay time.Duration
+}
+
+// Welcome is the welcome to send a user, rendered in their language
+type Welcome struct {
+	Variant  string
+	Delay    time.Duration
+	Text     string
+	Tips     []string
+	TipDelay time.Duration
+}
+
+// Welcome assigns the user a variant of the welcome flow & records it.
+// Users keep the variant they were first assigned, even if the variants or
+// their weights have since changed.
+func (s *Storage) Welcome(uid string) *Welcome {
+	var flow WelcomeFlow
+	var v WelcomeVariant
+	a, err := s.GetWelcomeAssignment(uid)
+	if err == nil {
+		var ok bool
+		flow = s.welcomeFlow(a.Campaign)
+		v, ok = flow.named(a.Variant)
+		if !ok {
+			jww.WARN.Printf("Welcome variant %s assigned to %s no longer exists", a.Variant, uid)
+		}
+	} else {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			jww.ERROR.Printf("Failed to get welcome variant of %s: %+v", uid, err)
+		}
+		flow = s.welcomeFlow(s.config.WelcomeCampaign)
+		v = flow.variant(s.config.WelcomeCampaign, uid)
+		err = s.InsertWelcomeAssignment(&WelcomeAssignment{
+			UserID:    uid,
+			Campaign:  s.config.WelcomeCampaign,
+			Variant:   v.Name,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			jww.ERROR.Printf("Failed to record welcome variant %s for %s: %+v", v.Name, uid, err)
+		}
+	}
+
+	w := &Welcome{
+		Variant:  v.Name,
+		Delay:    flow.Delay,
+		TipDelay: v.TipDelay,
+	}
+	if w.Delay == 0 {
+		w.Delay = defaultWelcomeDelay
+	}
+	texts := v.Texts
+	if len(texts) == 0 {
+		texts = []string{"intro"}
+	}
+	w.Text = s.Text(uid, texts[0], nil)
+	for _, name := range texts[1:] {
+		w.Tips = append(w.Tips, s.Text(uid, name, nil))
+	}
+	return w
+}
+
+// welcomeFlow returns the welcome flow of the campaign, or the default flow if
+// it has none
+func (s *Storage) welcomeFlow(campaign string) WelcomeFlow {
+	if c := s.campaign(campaign); c.Welcome != nil {
+		return *c.Welcome
+	}
+	return s.config.Welcome
+}
+
+// named returns the variant with the name, or the default variant & false if
+// there is none
+func (flow WelcomeFlow) named(name string) (WelcomeVariant, bool) {
+	for _, v := range flow.Variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return WelcomeVariant{Name: "default"}, name == "default"
+}
+
+// variant deterministically picks the user's variant by hashing their ID
+// with the campaign
+func (flow WelcomeFlow) variant(campaign, uid string) WelcomeVariant {
+	total := 0
+	for _, v := range flow.Variants {
+		total += v.weight()
+	}
+	if total == 0 {
+		return WelcomeVariant{Name: "default"}
+	}
+
+	h := sha256.Sum256([]byte(campaign + "/" + uid))
+	n := int(binary.BigEndian.Uint64(h[:8]) % uint64(total))
+	for _, v := range flow.Variants {
+		if n < v.weight() {
+			return v
+		}
+		n -= v.weight()
+	}
+	return flow.Variants[len(flow.Variants)-1]
+}
+
+// weight returns the variant's share of users, defaulting to 1
+func (v WelcomeVariant) weight() int {
+	if v.Weight <= 0 {
+		return 1
+	}
+	return v.Weight
+}
@@ -0,0 +1,78 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"testing"
+)
+
+// Tests that users keep the welcome variant they were first assigned after
+// the variant weights change, and are sent its texts
+func TestStorage_Welcome_KeepsAssignment(t *testing.T) {
+	s := newTestStorage(t, "", Config{Welcome: WelcomeFlow{Variants: []WelcomeVariant{
+		{Name: "intro", Texts: []string{"intro"}},
+		{Name: "help", Texts: []string{"tip.help"}},
+	}}})
+	uid := "user"
+
+	first := s.Welcome(uid)
+	other := "help"
+	if first.Variant == "help" {
+		other = "intro"
+	}
+
+	// Weight the other variant so heavily that a new assignment would pick it
+	for i, v := range s.config.Welcome.Variants {
+		if v.Name == other {
+			s.config.Welcome.Variants[i].Weight = 1 << 30
+		}
+	}
+	if v := s.config.Welcome.variant("", uid); v.Name != other {
+		t.Fatalf("Reweighted flow still picks %s for the user", v.Name)
+	}
+
+	again := s.Welcome(uid)
+	if again.Variant != first.Variant {
+		t.Errorf("User was assigned %s, then %s", first.Variant, again.Variant)
+	}
+	if again.Text != first.Text {
+		t.Errorf("User was sent %q, then %q", first.Text, again.Text)
+	}
+
+	stats, err := s.GetWelcomeStats()
+	if err != nil {
+		t.Fatalf("Failed to get welcome stats: %+v", err)
+	}
+	if len(stats) != 1 || stats[0].Variant != first.Variant || stats[0].Assigned != 1 {
+		t.Errorf("Expected one assignment to %s, got %+v", first.Variant, stats)
+	}
+}
+
+// Tests that users whose variant was removed get the default welcome without
+// being reassigned
+func TestStorage_Welcome_RemovedVariant(t *testing.T) {
+	s := newTestStorage(t, "", Config{Welcome: WelcomeFlow{Variants: []WelcomeVariant{
+		{Name: "help", Texts: []string{"tip.help"}},
+	}}})
+	uid := "user"
+	s.Welcome(uid)
+
+	s.config.Welcome.Variants = []WelcomeVariant{{Name: "mycode", Texts: []string{"tip.mycode"}}}
+	w := s.Welcome(uid)
+	if w.Text != s.Text(uid, "intro", nil) {
+		t.Errorf("Expected default welcome, got %q", w.Text)
+	}
+
+	a, err := s.GetWelcomeAssignment(uid)
+	if err != nil {
+		t.Fatalf("Failed to get welcome assignment: %+v", err)
+	}
+	if a.Variant != "help" {
+		t.Errorf("User was reassigned from help to %s", a.Variant)
+	}
+}